@@ -0,0 +1,223 @@
+package main
+
+import (
+	"image"
+	"image/draw"
+	"image/gif"
+	"strconv"
+	"time"
+)
+
+// Animated GIFs are composited into complete frames when they are loaded, so
+// playing them is only a matter of painting another image. The timer of the
+// frame shown is read by the canvas goroutine, see Canvas.run.
+
+// anim holds the frames of an animation.
+type anim struct {
+	frames []*tiled
+	delays []time.Duration
+	loops  int // Times the animation is played, 0 is forever.
+}
+
+// player is the state of the animation of the current image.
+type player struct {
+	frame  int
+	paused bool
+	played int // Times the animation was played through.
+	loops  int // Overrides anim.loops unless it is -1.
+
+	timer *time.Timer
+	tick  <-chan time.Time // timer.C while playing, nil otherwise.
+}
+
+// minDelay is used for frames without a delay (or a tiny one, which browsers
+// don't honour either).
+const minDelay = 100 * time.Millisecond
+
+// decodeGIF decodes every frame of a GIF file. It returns nil, and no error,
+// if f is not a GIF file.
+func decodeGIF(f imageData) (*gif.GIF, error) {
+	var magic [4]byte
+	if _, err := f.ReadAt(magic[:], 0); err != nil || string(magic[:]) != "GIF8" {
+		return nil, nil
+	}
+	return gif.DecodeAll(f)
+}
+
+// newAnim composites the frames of g according to their disposal methods.
+func newAnim(name string, g *gif.GIF) *anim {
+	start := time.Now()
+	r := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if r.Empty() {
+		for _, p := range g.Image {
+			r = r.Union(p.Bounds())
+		}
+	}
+
+	// A LoopCount of 0 loops forever, -1 plays the animation once and n
+	// plays it n+1 times.
+	a := &anim{loops: g.LoopCount + 1}
+	switch {
+	case g.LoopCount == 0:
+		a.loops = 0
+	case g.LoopCount < 0:
+		a.loops = 1
+	}
+
+	canvas := image.NewRGBA(r)
+	var prev *image.RGBA
+	for i, p := range g.Image {
+		disposal := byte(0)
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		if disposal == gif.DisposalPrevious {
+			prev = image.NewRGBA(r)
+			copy(prev.Pix, canvas.Pix)
+		}
+
+		draw.Draw(canvas, p.Bounds(), p, p.Bounds().Min, draw.Over)
+		frame := image.NewRGBA(r)
+		copy(frame.Pix, canvas.Pix)
+		a.frames = append(a.frames, newTiled(frame, nil, blends(frame)))
+
+		delay := minDelay
+		if i < len(g.Delay) && g.Delay[i] > 1 {
+			delay = time.Duration(g.Delay[i]) * 10 * time.Millisecond
+		}
+		a.delays = append(a.delays, delay)
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, p.Bounds(), image.Transparent, image.ZP, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = prev
+		}
+	}
+	lg("Composited the %d frames of '%s' (%s).", len(a.frames), name, time.Since(start))
+	return a
+}
+
+// startAnim plays the animation of the current image, if any, from its first
+// frame.
+func (c *Canvas) startAnim() {
+	c.stopAnim()
+	c.anim.frame, c.anim.played, c.anim.paused = 0, 0, false
+	if a := c.i.vimage.anim; a != nil {
+		c.i.vimage.tiled = a.frames[0]
+		c.playAnim()
+	}
+}
+
+// playAnim starts the timer of the frame shown.
+func (c *Canvas) playAnim() {
+	a := c.i.vimage.anim
+	if a == nil || c.anim.paused {
+		return
+	}
+	d := a.delays[c.anim.frame]
+	if c.anim.timer == nil {
+		c.anim.timer = time.NewTimer(d)
+	} else {
+		c.anim.timer.Reset(d)
+	}
+	c.anim.tick = c.anim.timer.C
+}
+
+// stopAnim stops the timer, if it is running.
+func (c *Canvas) stopAnim() {
+	if c.anim.tick != nil && !c.anim.timer.Stop() {
+		<-c.anim.timer.C
+	}
+	c.anim.tick = nil
+}
+
+// animTick is called when the delay of the frame shown is over.
+func (c *Canvas) animTick() {
+	c.anim.tick = nil
+	a := c.i.vimage.anim
+	if a == nil {
+		return
+	}
+	if c.anim.frame == len(a.frames)-1 {
+		c.anim.played++
+		loops := a.loops
+		if c.anim.loops >= 0 {
+			loops = c.anim.loops
+		}
+		if loops > 0 && c.anim.played >= loops {
+			c.anim.paused = true
+			return
+		}
+	}
+	c.showFrame(c.anim.frame + 1)
+	c.playAnim()
+}
+
+// showFrame paints frame i (wrapping around) of the current animation.
+func (c *Canvas) showFrame(i int) {
+	a := c.i.vimage.anim
+	n := len(a.frames)
+	c.anim.frame = (i%n + n) % n
+	c.i.vimage.tiled = a.frames[c.anim.frame]
+	c.origin = c.show(c.origin)
+}
+
+// animCmd runs the "play", "frame" and "loop" commands.
+func (c *Canvas) animCmd(cmd cmd) {
+	a := c.i.vimage.anim
+
+	switch cmd[0] {
+	case "play":
+		if a == nil {
+			return
+		}
+		paused := !c.anim.paused
+		if len(cmd) > 1 {
+			paused = cmd[1] == "off"
+		}
+		c.stopAnim()
+		c.anim.paused = paused
+		if !paused {
+			// Start over if it was stopped at the end.
+			c.anim.played = 0
+		}
+		c.playAnim()
+
+	case "frame":
+		if a == nil {
+			return
+		}
+		c.stopAnim()
+		c.anim.paused = true
+		switch cmd[1] {
+		case "next":
+			c.showFrame(c.anim.frame + 1)
+		case "prev":
+			c.showFrame(c.anim.frame - 1)
+		default:
+			n, err := strconv.Atoi(cmd[1])
+			if err != nil || n < 1 || n > len(a.frames) {
+				errLg.Printf("Invalid frame number: %v", cmd)
+				return
+			}
+			c.showFrame(n - 1)
+		}
+
+	case "loop":
+		switch cmd[1] {
+		case "forever":
+			c.anim.loops = 0
+		case "file":
+			c.anim.loops = -1
+		default:
+			n, err := strconv.Atoi(cmd[1])
+			if err != nil || n < 1 {
+				errLg.Printf("Invalid loop count: %v", cmd)
+				return
+			}
+			c.anim.loops = n
+		}
+		c.anim.played = 0
+	}
+}
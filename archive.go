@@ -0,0 +1,360 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Zip (and cbz) and tar (possibly gzipped) archives given as arguments are
+// shown like directories holding their images, named "archive.zip:member".
+// Only the list of members is read up front, each member is read when its
+// image is loaded. Gzipped tar files can't be read from the middle, so the
+// last one loaded from is decompressed to a temporary file as it is read.
+
+var errNotArchive = errors.New("not an archive")
+
+// archiveKind returns "zip", "tar" or "tar.gz" if the contents of the file
+// name look like such an archive, or "" otherwise.
+func archiveKind(name string) string {
+	f, err := os.Open(name)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	var hdr [512]byte
+	n, _ := io.ReadFull(f, hdr[:])
+	switch {
+	case bytes.HasPrefix(hdr[:n], []byte("PK\x03\x04")):
+		return "zip"
+	case bytes.HasPrefix(hdr[:n], []byte("\x1f\x8b")):
+		// Only gzipped tar files, not any gzipped file.
+		if _, err := f.Seek(0, 0); err != nil {
+			return ""
+		}
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return ""
+		}
+		if n, _ = io.ReadFull(zr, hdr[:]); isTar(hdr[:n]) {
+			return "tar.gz"
+		}
+	case isTar(hdr[:n]):
+		return "tar"
+	}
+	return ""
+}
+
+// isTar reports whether hdr is the header of a POSIX or GNU tar file.
+func isTar(hdr []byte) bool {
+	return len(hdr) == 512 && bytes.HasPrefix(hdr[257:], []byte("ustar"))
+}
+
+// member is an image inside an archive.
+type member struct {
+	archive string
+	kind    string    // As returned by archiveKind.
+	mtime   time.Time // Of the archive, when its members were listed.
+	index   int       // Position in the archive, counting every entry.
+	off     int64     // Of the contents in the (decompressed) tar file, or -1.
+	path    string    // Inside the archive.
+	info    os.FileInfo
+}
+
+func (m *member) stat() (os.FileInfo, error) { return m.info, nil }
+func (m *member) file() string               { return "" }
+
+// open reads the member into memory, the decoders need to seek. Its position
+// in the archive was recorded when it was listed, so that loading every member
+// in turn doesn't read the archive from the start every time. The archive is
+// only searched again if it changed since.
+func (m *member) open() (imageData, error) {
+	fi, err := os.Stat(m.archive)
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	switch {
+	case !fi.ModTime().Equal(m.mtime) || (m.kind != "zip" && m.off < 0):
+		data, err = m.search()
+	case m.kind == "zip":
+		data, err = m.readZip()
+	case m.kind == "tar":
+		data, err = m.readTar()
+	default:
+		data, err = gunzipTar(m.archive, m.mtime, m.off, m.info.Size())
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("'%s' is truncated in '%s'", m.path, m.archive)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return memData{bytes.NewReader(data)}, nil
+}
+
+// readZip reads the member of a zip file, from its entry in the central
+// directory.
+func (m *member) readZip() ([]byte, error) {
+	zr, err := zip.OpenReader(m.archive)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	if m.index >= len(zr.File) || zr.File[m.index].Name != m.path {
+		return m.search()
+	}
+	r, err := zr.File[m.index].Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// readTar reads the member of an uncompressed tar file at its offset.
+func (m *member) readTar() ([]byte, error) {
+	f, err := os.Open(m.archive)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data := make([]byte, m.info.Size())
+	if _, err := f.ReadAt(data, m.off); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// search reads the member by going through the archive from the start.
+func (m *member) search() ([]byte, error) {
+	var data []byte
+	err := eachMember(m.archive, m.kind, func(_ int, _ int64, path string, _ os.FileInfo, r io.Reader) (bool, error) {
+		if path != m.path {
+			return true, nil
+		}
+		var err error
+		data, err = ioutil.ReadAll(r)
+		return false, err
+	})
+	if err == nil && data == nil {
+		err = fmt.Errorf("'%s' is no longer in '%s'", m.path, m.archive)
+	}
+	return data, err
+}
+
+// gunzipped is the last gzipped tar file read from by gunzipTar. Its members
+// are usually loaded one after the other, so it is decompressed to a
+// temporary file, only as far as the members read so far.
+var gunzipped struct {
+	sync.Mutex
+	name  string
+	mtime time.Time
+	f     *os.File
+	zr    *gzip.Reader
+	tmp   *os.File // Removed once created, it goes away when closed.
+	n     int64    // Bytes decompressed to tmp.
+}
+
+// gunzipTar reads size bytes at off in the decompressed contents of the
+// gzipped tar file name, as of mtime. It returns io.ErrUnexpectedEOF if they
+// are not all there.
+func gunzipTar(name string, mtime time.Time, off, size int64) ([]byte, error) {
+	gunzipped.Lock()
+	defer gunzipped.Unlock()
+	if gunzipped.name != name || !gunzipped.mtime.Equal(mtime) {
+		closeGunzipped()
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		zr, err := gzip.NewReader(bufio.NewReader(f))
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		tmp, err := ioutil.TempFile("", "vimg-")
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		os.Remove(tmp.Name())
+		gunzipped.name, gunzipped.mtime = name, mtime
+		gunzipped.f, gunzipped.zr, gunzipped.tmp = f, zr, tmp
+	}
+
+	if end := off + size; end > gunzipped.n {
+		n, err := io.CopyN(gunzipped.tmp, gunzipped.zr, end-gunzipped.n)
+		gunzipped.n += n
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		} else if err != nil {
+			closeGunzipped()
+			return nil, err
+		}
+	}
+	data := make([]byte, size)
+	if _, err := gunzipped.tmp.ReadAt(data, off); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// closeGunzipped forgets the gzipped tar file being read, freeing its
+// temporary file.
+func closeGunzipped() {
+	if gunzipped.f != nil {
+		gunzipped.f.Close()
+		gunzipped.tmp.Close()
+	}
+	gunzipped.name, gunzipped.f, gunzipped.zr, gunzipped.tmp, gunzipped.n = "", nil, nil, nil, 0
+}
+
+// countReader counts the bytes read from it.
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// contiguous reports whether the contents of a tar entry are stored as they
+// are, which is not the case of sparse files.
+func contiguous(h *tar.Header) bool {
+	if h.Typeflag == tar.TypeGNUSparse {
+		return false
+	}
+	for k := range h.PAXRecords {
+		if strings.HasPrefix(k, "GNU.sparse.") {
+			return false
+		}
+	}
+	return true
+}
+
+// eachMember calls f with every regular file in the archive name, in the
+// order they are stored, until it returns false or an error. Its index counts
+// every entry of the archive (it is the index in zip.Reader.File for zip
+// files), off is the offset of its contents in the decompressed tar file (or
+// -1), and r reads its contents.
+func eachMember(name, kind string, f func(index int, off int64, path string, fi os.FileInfo, r io.Reader) (bool, error)) error {
+	if kind == "zip" {
+		zr, err := zip.OpenReader(name)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		for i, zf := range zr.File {
+			if !zf.Mode().IsRegular() {
+				continue
+			}
+			r, err := zf.Open()
+			if err != nil {
+				return err
+			}
+			more, err := f(i, -1, zf.Name, zf.FileInfo(), r)
+			r.Close()
+			if !more || err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	// The tar reader reads the headers exactly, so the offset of the
+	// contents is where it stopped.
+	offset := func() int64 {
+		off, err := file.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return -1
+		}
+		return off
+	}
+	var r io.Reader = file
+	if kind == "tar.gz" {
+		zr, err := gzip.NewReader(bufio.NewReader(file))
+		if err != nil {
+			return err
+		}
+		cr := &countReader{r: zr}
+		r, offset = cr, func() int64 { return cr.n }
+	}
+	tr := tar.NewReader(r)
+	for i := 0; ; i++ {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if !h.FileInfo().Mode().IsRegular() {
+			continue
+		}
+		off := int64(-1)
+		if contiguous(h) {
+			off = offset()
+		}
+		if more, err := f(i, off, h.Name, h.FileInfo(), tr); !more || err != nil {
+			return err
+		}
+	}
+}
+
+// archiveImages returns the images in the archive name, in natural order of
+// their paths inside it. Only their headers are read. It returns
+// errNotArchive if name is not an archive.
+func archiveImages(name string) ([]*Img, error) {
+	kind := archiveKind(name)
+	if kind == "" {
+		return nil, errNotArchive
+	}
+
+	afi, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	var members []*member
+	err = eachMember(name, kind, func(i int, off int64, path string, fi os.FileInfo, r io.Reader) (bool, error) {
+		if excluded(path) || !included(path) {
+			return true, nil
+		}
+		if _, _, err := image.DecodeConfig(bufio.NewReader(r)); err != image.ErrFormat {
+			members = append(members, &member{name, kind, afi.ModTime(), i, off, path, fi})
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(members, func(i, j int) bool {
+		return naturalLess(members[i].path, members[j].path)
+	})
+	imgs := make([]*Img, len(members))
+	for i, m := range members {
+		imgs[i] = newSourceImg(name+":"+m.path, m)
+	}
+	return imgs, nil
+}
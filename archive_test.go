@@ -0,0 +1,174 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// archiveMembers are the paths of the files in the test archives, those that
+// end in ".png" are images as wide as their position in the list.
+var archiveMembers = []string{
+	"p10.png",
+	"notes.txt",
+	"p2.png",
+	"dir/p1.png",
+	// Long enough to need an extra header.
+	strings.Repeat("long/", 30) + "p3.png",
+}
+
+func archiveMember(i int) []byte {
+	if !strings.HasSuffix(archiveMembers[i], ".png") {
+		return []byte("not an image")
+	}
+	var b bytes.Buffer
+	png.Encode(&b, image.NewGray(image.Rect(0, 0, i+1, 1)))
+	return b.Bytes()
+}
+
+func writeArchive(t *testing.T, name string) {
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if strings.HasSuffix(name, ".zip") {
+		zw := zip.NewWriter(f)
+		for i, path := range archiveMembers {
+			w, _ := zw.Create(path)
+			w.Write(archiveMember(i))
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	var w io.Writer = f
+	if strings.HasSuffix(name, ".gz") {
+		zw := gzip.NewWriter(f)
+		defer zw.Close()
+		w = zw
+	}
+	tw := tar.NewWriter(w)
+	tw.WriteHeader(&tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755})
+	for i, path := range archiveMembers {
+		data := archiveMember(i)
+		tw.WriteHeader(&tar.Header{Name: path, Size: int64(len(data)), Mode: 0644, Format: tar.FormatPAX})
+		tw.Write(data)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestArchiveImages(t *testing.T) {
+	dir := t.TempDir()
+	for _, kind := range []string{"zip", "tar", "tar.gz"} {
+		name := filepath.Join(dir, "images."+kind)
+		writeArchive(t, name)
+		if k := archiveKind(name); k != kind {
+			t.Errorf("archiveKind(%s) = %q, want %q", name, k, kind)
+			continue
+		}
+
+		imgs, err := archiveImages(name)
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		var got []string
+		for _, im := range imgs {
+			got = append(got, strings.TrimPrefix(im.name, name+":"))
+		}
+		want := []string{"dir/p1.png", strings.Repeat("long/", 30) + "p3.png", "p2.png", "p10.png"}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%s: images are %q, want %q", name, got, want)
+			continue
+		}
+
+		load := func() {
+			// Backwards, not in the order they are stored.
+			for i := len(imgs) - 1; i >= 0; i-- {
+				im := imgs[i]
+				d, err := im.src.open()
+				if err != nil {
+					t.Errorf("%s: %s", im.name, err)
+					continue
+				}
+				m, _, err := image.Decode(d)
+				d.Close()
+				path := strings.TrimPrefix(im.name, name+":")
+				for j, p := range archiveMembers {
+					if p != path {
+						continue
+					}
+					if err != nil {
+						t.Errorf("%s: %s", im.name, err)
+					} else if m.Bounds().Dx() != j+1 {
+						t.Errorf("%s: read the image of another member", im.name)
+					}
+				}
+			}
+		}
+		load()
+
+		// Members are found again in an archive that changed.
+		archiveMembers[0], archiveMembers[1] = archiveMembers[1], archiveMembers[0]
+		writeArchive(t, name)
+		later := time.Now().Add(time.Minute)
+		os.Chtimes(name, later, later)
+		load()
+		archiveMembers[0], archiveMembers[1] = archiveMembers[1], archiveMembers[0]
+	}
+
+	name := filepath.Join(dir, "notes.gz")
+	f, _ := os.Create(name)
+	zw := gzip.NewWriter(f)
+	zw.Write([]byte("not a tar file"))
+	zw.Close()
+	f.Close()
+	if _, err := archiveImages(name); err != errNotArchive {
+		t.Errorf("archiveImages(%s) = %v, want errNotArchive", name, err)
+	}
+}
+
+func TestGunzipTar(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "images.tar.gz")
+	writeArchive(t, name)
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		gunzipped.Lock()
+		closeGunzipped()
+		gunzipped.Unlock()
+	}()
+
+	// Only as much as needed is decompressed.
+	data, err := gunzipTar(name, fi.ModTime(), 0, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gunzipped.n != 512 {
+		t.Errorf("decompressed %d bytes to read the first 512", gunzipped.n)
+	}
+	if _, err := tar.NewReader(bytes.NewReader(data)).Next(); err != nil {
+		t.Errorf("the first header doesn't read back: %s", err)
+	}
+	if _, err := gunzipTar(name, fi.ModTime(), 1<<20, 1); err != io.ErrUnexpectedEOF {
+		t.Errorf("reading past the end: got %v, want io.ErrUnexpectedEOF", err)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/BurntSushi/xgb/xproto"
+)
+
+// The background is what shows through the transparent parts of images, and
+// around them in the window. In "checker" mode, images are blended into a
+// checkered background (see convert.go) and the window is --background. In
+// "solid" mode both are --background, and in "black" mode both are black.
+
+var backgroundModes = []string{"checker", "solid", "black"}
+
+// bgMode is the index in backgroundModes of the current mode. It is changed by
+// the canvas goroutine and read by the preloaders too, so it is only accessed
+// atomically.
+var bgMode int32
+
+// setBackgroundMode sets the background mode by name.
+func setBackgroundMode(name string) error {
+	for i, m := range backgroundModes {
+		if m == name {
+			atomic.StoreInt32(&bgMode, int32(i))
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown background mode '%s', want one of %s",
+		name, strings.Join(backgroundModes, ", "))
+}
+
+// newChecker returns the background that images are blended into in mode.
+// Solid backgrounds are checkers of a single color.
+func newChecker(mode int32) *checker {
+	switch backgroundModes[mode] {
+	case "solid":
+		c := flagBackground.BGRA()
+		return &checker{size: 1, light: c, dark: c}
+	case "black":
+		c := rgb(0).BGRA()
+		return &checker{size: 1, light: c, dark: c}
+	}
+	return &checker{
+		size:  max(1, flagCheckerSize),
+		light: flagCheckerLight.BGRA(),
+		dark:  flagCheckerDark.BGRA(),
+	}
+}
+
+// windowColor returns the color of the window around the image.
+func windowColor() rgb {
+	if backgroundModes[atomic.LoadInt32(&bgMode)] == "black" {
+		return 0
+	}
+	return flagBackground
+}
+
+// setBackground changes the background of the window to windowColor.
+func (w *Window) setBackground() {
+	xproto.ChangeWindowAttributes(w.X.Conn(), w.Id, xproto.CwBackPixel,
+		[]uint32{uint32(windowColor())})
+}
+
+// background switches to the background mode name, or to the next one if
+// name is empty, and paints the current image again.
+func (c *Canvas) background(name string) {
+	if name == "" {
+		mode := atomic.LoadInt32(&bgMode)
+		name = backgroundModes[(int(mode)+1)%len(backgroundModes)]
+	}
+	if err := setBackgroundMode(name); err != nil {
+		errLg.Print(err)
+		return
+	}
+	lg("Background mode is now '%s'.", name)
+
+	// The tiles notice the change and are converted again, see tiled.tile.
+	window.setBackground()
+	window.ClearAll()
+	c.origin = c.show(c.origin)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// External commands can be run on several images at once: the marked ones,
+// or the current one if none is marked. "batch" runs a single command with
+// all their names, "each" runs one command per image, several at a time.
+// Both run in the background, like "&". Afterwards the images whose files are
+// gone are dropped from the list, and the others are loaded again since the
+// command may have changed them.
+
+// targets returns the files of the marked images, or of the current image if
+// none is marked. Images that are not files are skipped.
+func (c *Canvas) targets() (files []string) {
+	ims := []*Img{c.i}
+	if c.marks() > 0 {
+		ims = nil
+		for _, im := range c.imgs {
+			if im.marked {
+				ims = append(ims, im)
+			}
+		}
+	}
+	for _, im := range ims {
+		if f := im.src.file(); f != "" {
+			files = append(files, f)
+		} else {
+			errLg.Printf("Skipping '%s', it is not a file.", im.name)
+		}
+	}
+	return
+}
+
+// expand replaces the placeholders in args for the file name: '%' and '%s'
+// (as whole arguments) by name, and '%d', '%b' and '%e' by its directory, its
+// base name without the extension and its extension. '%%' is a '%'.
+func expand(args []string, name string) []string {
+	ext := filepath.Ext(name)
+	r := strings.NewReplacer(
+		"%%", "%",
+		"%d", filepath.Dir(name),
+		"%b", strings.TrimSuffix(filepath.Base(name), ext),
+		"%e", ext)
+	out := make([]string, len(args))
+	for i, a := range args {
+		if a == "%" || a == "%s" {
+			out[i] = name
+		} else {
+			out[i] = r.Replace(a)
+		}
+	}
+	return out
+}
+
+// expandFile replaces the arguments '%' in args by name. It is all "!" and "&"
+// replace, '%' within arguments is left alone for the commands that use it
+// for something else (like date).
+func expandFile(args []string, name string) []string {
+	out := make([]string, len(args))
+	for i, a := range args {
+		if a == "%" {
+			a = name
+		}
+		out[i] = a
+	}
+	return out
+}
+
+// placeholders reports whether any of args has a placeholder for the file
+// name, see expand.
+func placeholders(args []string) bool {
+	for _, a := range args {
+		if a == "%" || a == "%s" {
+			return true
+		}
+		a = strings.Replace(a, "%%", "", -1)
+		if strings.Contains(a, "%d") || strings.Contains(a, "%b") || strings.Contains(a, "%e") {
+			return true
+		}
+	}
+	return false
+}
+
+// batchArgs returns the command run by "batch": args, with the arguments '%'
+// and '%s' replaced by files (or followed by them, if there are none) and '%%'
+// by '%'. The placeholders for a single file name are an error.
+func batchArgs(args, files []string) ([]string, error) {
+	var argv []string
+	listed := false
+	for _, a := range args {
+		switch {
+		case a == "%" || a == "%s":
+			argv = append(argv, files...)
+			listed = true
+		case placeholders([]string{a}):
+			return nil, fmt.Errorf("'%s': batch only replaces '%%s' by the file names", a)
+		default:
+			argv = append(argv, strings.Replace(a, "%%", "%", -1))
+		}
+	}
+	if !listed {
+		argv = append(argv, files...)
+	}
+	return argv, nil
+}
+
+// batch runs the "batch" command on the targets, see batchArgs.
+func (c *Canvas) batch(args []string) {
+	files := c.targets()
+	if len(files) == 0 {
+		return
+	}
+	argv, err := batchArgs(args, files)
+	if err != nil {
+		errLg.Print(err)
+		c.message([]string{err.Error()})
+		return
+	}
+	c.startExternal(argv, files)
+}
+
+// each runs the "each" command: args, expanded for every target in turn, or
+// followed by its name if they have no placeholder. With '-j n' as the first
+// arguments, up to n commands run at the same time (by default --jobs).
+func (c *Canvas) each(args []string) {
+	jobs := flagJobs
+	if len(args) > 2 && args[0] == "-j" {
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 1 {
+			errLg.Printf("Invalid number of jobs: %v", args)
+			return
+		}
+		jobs, args = n, args[2:]
+	}
+	if !placeholders(args) {
+		args = append(args[:len(args):len(args)], "%")
+	}
+	files := c.targets()
+	if len(files) == 0 {
+		return
+	}
+
+	c.start(files, func(ctx context.Context) []string {
+		errs := make([]error, len(files))
+		sem := make(chan bool, max(jobs, 1))
+		var wg sync.WaitGroup
+		for i, f := range files {
+			sem <- true
+			if ctx.Err() != nil {
+				// Cancelled, don't start the others.
+				errs[i] = errCancelled
+				<-sem
+				continue
+			}
+			wg.Add(1)
+			go func(i int, f string) {
+				defer wg.Done()
+				_, errs[i] = runExternal(ctx, expand(args, f))
+				<-sem
+			}(i, f)
+		}
+		wg.Wait()
+
+		failed := 0
+		for i, err := range errs {
+			if err != nil {
+				errLg.Printf("%s failed on '%s': %s", args[0], files[i], err)
+				failed++
+			}
+		}
+		msg := fmt.Sprintf("%s: done on %d images", args[0], len(files))
+		if failed > 0 {
+			msg = fmt.Sprintf("%s failed on %d of %d images", args[0], failed, len(files))
+			errLg.Print(msg)
+		}
+		return []string{msg}
+	})
+	c.message([]string{fmt.Sprintf("%s: started on %d images", args[0], len(files))})
+}
+
+// resync updates the image list after files were handed to external
+// commands: images whose file no longer exists are dropped, and the images
+// of files are loaded again. The current image stays, or the next one that
+// is left takes its place.
+func (c *Canvas) resync(files []string) {
+	touched := map[string]bool{}
+	for _, f := range files {
+		touched[f] = true
+	}
+
+	var kept []*Img
+	current := 0
+	for i, im := range c.imgs {
+		if i == c.current {
+			current = len(kept)
+		}
+		f := im.src.file()
+		if f == "" {
+			kept = append(kept, im)
+			continue
+		}
+		if _, err := os.Stat(f); err != nil {
+			lg("'%s' is gone, dropping it.", f)
+			sched.forget(im)
+			delete(c.keys, im)
+			continue
+		}
+		if touched[f] {
+			sched.forget(im)
+		}
+		kept = append(kept, im)
+	}
+	if len(kept) == 0 {
+		errLg.Fatal("No images left in image list!")
+	}
+	c.imgs = kept
+	c.setImage(current)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestExpand(t *testing.T) {
+	const name = "/pics/2020/img.1.jpg"
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"rm", "%"}, "[rm /pics/2020/img.1.jpg]"},
+		{[]string{"mv", "%s", "keep/"}, "[mv /pics/2020/img.1.jpg keep/]"},
+		{[]string{"convert", "%", "%d/small-%b%e"}, "[convert /pics/2020/img.1.jpg /pics/2020/small-img.1.jpg]"},
+		{[]string{"echo", "100%%", "%%s", "x%"}, "[echo 100% %s x%]"},
+		{[]string{"date"}, "[date]"},
+	} {
+		if got := fmt.Sprint(expand(tt.args, name)); got != tt.want {
+			t.Errorf("expand(%q) = %s, want %s", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestPlaceholders(t *testing.T) {
+	for _, tt := range []struct {
+		args []string
+		want bool
+	}{
+		{[]string{"rm", "%"}, true},
+		{[]string{"mv", "%s", "keep/"}, true},
+		{[]string{"cp", "x", "%d/copy-%b%e"}, true},
+		{[]string{"gimp"}, false},
+		{[]string{"convert", "-resize", "50%"}, false},
+		{[]string{"printf", "%%s\n"}, false},
+		{[]string{"printf", "%%%b"}, true},
+		// Only whole arguments are replaced by the name.
+		{[]string{"echo", "x%s"}, false},
+	} {
+		if got := placeholders(tt.args); got != tt.want {
+			t.Errorf("placeholders(%q) = %v, want %v", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestExpandFile(t *testing.T) {
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"gimp", "%"}, "[gimp /pics/a.jpg]"},
+		// Only '%' as a whole argument is the file name.
+		{[]string{"date", "+%d", "%s", "%%"}, "[date +%d %s %%]"},
+		{[]string{"ls"}, "[ls]"},
+	} {
+		if got := fmt.Sprint(expandFile(tt.args, "/pics/a.jpg")); got != tt.want {
+			t.Errorf("expandFile(%q) = %s, want %s", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestBatchArgs(t *testing.T) {
+	files := []string{"a.jpg", "b c.jpg"}
+	for _, tt := range []struct {
+		args []string
+		want string // Or the error.
+	}{
+		{[]string{"mv", "%s", "keep/"}, "[mv a.jpg b c.jpg keep/]"},
+		{[]string{"rm", "%"}, "[rm a.jpg b c.jpg]"},
+		{[]string{"rm"}, "[rm a.jpg b c.jpg]"},
+		{[]string{"convert", "-resize", "50%%", "-append", "%", "out.jpg"}, "[convert -resize 50% -append a.jpg b c.jpg out.jpg]"},
+		{[]string{"convert", "-resize", "50%"}, "[convert -resize 50% a.jpg b c.jpg]"},
+		{[]string{"cp", "%s", "%d/"}, "error: '%d/': batch only replaces '%s' by the file names"},
+		{[]string{"echo", "%b%e"}, "error: '%b%e': batch only replaces '%s' by the file names"},
+	} {
+		argv, err := batchArgs(tt.args, files)
+		got := fmt.Sprint(argv)
+		if err != nil {
+			got = "error: " + err.Error()
+		}
+		if got != tt.want {
+			t.Errorf("batchArgs(%q) = %s, want %s", tt.args, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"sort"
+)
+
+// The scheduler keeps track of the memory used by loaded images. Once it goes
+// over budget, the images outside the preload window are evicted, farthest
+// from the current image first. Evicted images are loaded again through load()
+// the next time they are needed, as if they had never been loaded.
+
+// done hands the result of loading im to the canvas and accounts for it. If im
+// was freed since it was claimed (gen is not current any more), the result is
+// stale and dropped. The send can't block while s.mu is held: if the slot is
+// somehow taken already, the result is dropped as well.
+func (s *scheduler) done(im *Img, vimg *vimage, gen int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if im.gen != gen {
+		vimg.destroy()
+		return
+	}
+	select {
+	case im.load <- vimg:
+	default:
+		vimg.destroy()
+		return
+	}
+	s.sizes[im] = vimg.size()
+	s.size += vimg.size()
+}
+
+// account updates the memory used by im, which changes as its tiles are
+// converted and dropped. It is called from the canvas goroutine.
+func (s *scheduler) account(im *Img) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.sizes[im]; !ok || im.vimage == nil {
+		return
+	}
+	n := im.vimage.size()
+	s.size += n - s.sizes[im]
+	s.sizes[im] = n
+}
+
+// evict frees loaded images outside the preload window until the cache is
+// back under budget. s.mu must be held.
+func (s *scheduler) evict(imgs []*Img, idx int) {
+	if s.size <= s.budget {
+		return
+	}
+
+	pos := make(map[*Img]int, len(imgs))
+	for i, im := range imgs {
+		pos[im] = i
+	}
+
+	// Images no longer in the list are the first to go.
+	dist := func(im *Img) int {
+		i, ok := pos[im]
+		if !ok {
+			return len(imgs)
+		}
+		d := (i - idx + len(imgs)) % len(imgs)
+		return min(d, len(imgs)-d)
+	}
+
+	var cands []*Img
+	for im := range s.sizes {
+		if _, ok := s.wanted[im]; !ok {
+			cands = append(cands, im)
+		}
+	}
+	sort.Slice(cands, func(i, j int) bool { return dist(cands[i]) > dist(cands[j]) })
+
+	for _, im := range cands {
+		if s.size <= s.budget {
+			break
+		}
+		lg("Evicting '%s' from the cache.", im.name)
+		s.free(im)
+	}
+}
+
+// forget frees im right away, whether it is loaded, failed to load or is
+// being loaded. It is used when im is removed from the image list or its file
+// changes.
+func (s *scheduler) forget(im *Img) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.free(im)
+	s.cond.Broadcast()
+}
+
+// free destroys the pixmap of im and drops its image data, leaving it as if
+// it had never been loaded. s.mu must be held and, since it touches
+// im.vimage, it must be called from the canvas goroutine.
+func (s *scheduler) free(im *Img) {
+	select {
+	case vimg := <-im.load:
+		vimg.destroy()
+	default:
+	}
+	im.vimage = nil
+	im.loading = false
+	im.gen++
+
+	s.size -= s.sizes[im]
+	delete(s.sizes, im)
+}
@@ -4,94 +4,82 @@ import (
 	"fmt"
 	"image"
 	"os"
-	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/xgbutil/xgraphics"
 )
 
 type chans struct {
 	ctl chan cmd
 
+	// Key presses typed into the command line, see prompt.go.
+	key chan string
+
 	// The pan{Start,Step}Chan channels for "drag start", "drag step".
 	panStartChan chan image.Point
 	panStepChan  chan image.Point
-}
 
-func load(im *Img) (vimg *vimage) {
-	if im.vimage != nil {
-		return im.vimage
-	}
-	// Skip image if already loaded.
-	select {
-	case vimg = <-im.load:
-		im.load <- vimg
-		return
-	default:
-	}
+	// Changes to the files and directories being shown, see watch.go.
+	fs chan fsEvent
 
-	vimg = newImage(im)
+	// Commands read from the socket, see remote.go.
+	remote chan remoteReq
 
-	// Tell the canvas that this image has been loaded.
-	select {
-	case im.load <- vimg:
-	default:
-		lg("XXXX Somebody else loaded img faster than us! %v", im)
-	}
-
-	return
+	// Images named on stdin, see streamFiles.
+	files chan []*Img
 }
 
-func loader(imgs chan *Img) {
-	for im := range imgs {
-		load(im)
-		runtime.Gosched()
-	}
-}
+type Canvas struct {
+	imgs    []*Img
+	i       *Img
+	current int
+	origin  image.Point
+	order   string // Sort order of imgs, see sortImages.
+	reverse bool
+	keys    map[*Img]interface{} // Sort keys of imgs, computed as needed.
 
-var preloaders chan *Img
+	zoom float64          // Scale factor of the current image, 1 is 1:1.
+	fit  bool             // If set, zoom is recomputed to fit the window.
+	view *xgraphics.Image // Buffer holding the scaled visible region.
 
-const PreloadQueueSize = 32
+	anim player // Playback of the current image, if animated.
 
-func preload(imgs []*Img, idx int) {
+	prompt prompt // The command line.
+	help   int    // Scroll position of the help, -1 when it is hidden.
 
-	if preloaders == nil {
-		preloaders = make(chan *Img, PreloadQueueSize)
-		for i := 0; i < runtime.NumCPU(); i++ {
-			go loader(preloaders)
-		}
-	}
+	// What was painted by the last call to show: shownArea of the current
+	// image (or of shown, the scaled view, when zoomed) at shownAt in the
+	// window.
+	shown     *xgraphics.Image
+	shownArea image.Rectangle
+	shownAt   image.Point
 
-	// TODO: Should wrap arround!
-	// TODO: Replace FIFO with "priority queue" based on distance from idx
-	for i := 0; i <= PreloadQueueSize && i+idx < len(imgs); i++ {
-		img := imgs[i+idx]
-		if img.vimage == nil && img.loading == false {
-			select {
-			case preloaders <- img:
-				img.loading = true
-			default:
-				// Preload queue full
-				break
-			}
-		}
-	}
-	// TODO: 'Garbage collect' far away images when free memory is low.
-	//fidx := idx+len(imgs)/2 // Start freeing as far away as possible
-	// TODO: preload also for when iterating backwards?
-	// could use last step to predict the general iteraction direction.
-}
+	overlays []image.Rectangle // Areas of the window painted over the image.
 
-type Canvas struct {
-	imgs    []*Img
-	i       *Img
-	current int
-	origin  image.Point
+	msg  message      // Shown at the bottom of the window, see external.go.
+	jobs []*job       // External commands running in the background.
+	done chan jobDone // Where jobs are sent once they exit.
 }
 
 func (c *Canvas) delImage(i int) {
+	sched.forget(c.imgs[i])
+	delete(c.keys, c.imgs[i])
 	c.imgs = append(c.imgs[:i], c.imgs[i+1:]...)
 	if len(c.imgs) == 0 {
 		errLg.Fatal("No images left in image list!")
 	}
-	c.setImage(c.current)
+
+	// Only the current image needs to be replaced on screen.
+	switch {
+	case i < c.current:
+		c.current--
+		fallthrough
+	case i > c.current:
+		preload(c.imgs, c.current)
+	default:
+		c.setImage(c.current)
+	}
 }
 
 func (c *Canvas) setImage(i int) {
@@ -106,22 +94,24 @@ func (c *Canvas) setImage(i int) {
 
 	c.current = i
 	c.i = c.imgs[i]
+
+	// Reprioritize the preloaders before loading, so they move on to the
+	// neighbours of this image instead of working on stale ones.
+	preload(c.imgs, i)
 	if c.i.vimage == nil {
 		window.setName(fmt.Sprintf("%s - Loading... ", c.i.name))
-		// TODO Maybe should check if a preloader is already working on this image.
-		c.i.loading = true
 		c.i.vimage = load(c.i)
 	}
 
+	// Images that could not be loaded stay in the list, shown as an error
+	// card.
 	if c.i.vimage.err != nil {
 		errLg.Printf("%s - Error loading... %s", c.i.name, c.i.vimage.err)
-		c.delImage(i)
-		return
 	}
 
-	c.origin = show(c.i, image.Point{0, 0})
+	c.startAnim()
+	c.origin = c.show(image.Point{0, 0})
 	lg("show() %v, %d, %s", c.i.vimage, len(c.i.load), c.i.name)
-	preload(c.imgs, i+1)
 }
 
 // canvas is meant to be run as goroutine that maintains the state of the image
@@ -135,96 +125,252 @@ func (c *Canvas) run(chans chans) {
 	for {
 		select {
 		case cmd := <-chans.ctl:
-			switch cmd[0] {
-			case "next":
-				c.setImage(c.current + 1)
-
-			case "prev":
-				c.setImage(c.current - 1)
-
-			// resize the window to fit the current image.
-			// Not needed since we are always full screen
-			// and if we arent fs, resize maybe should be automatic
-			//case "fit":
-			//	b := imgs[current].vimage.Bounds()
-			//	window.Resize(b.Dx(), b.Dy())
-			case "pan":
-				switch cmd[1] {
-				case "left":
-					c.origin.X -= panIncrement
-				case "right":
-					c.origin.X += panIncrement
-
-				// up and down are reversed, X origin is the top-left corner
-				case "up":
-					c.origin.Y -= panIncrement
-				case "down":
-					c.origin.Y += panIncrement
-				}
-				c.origin = show(c.i, c.origin)
-			case "quit":
-				// Xgb bug prevents this from working?
-				// Anything wrong with calling os.Exit() directly? 
-				//xevent.Quit(window.X) 
-				os.Exit(0)
-			case "!":
-				runExternal(cmd.Args(), c.i.name)
-				if _, err := os.Stat(c.i.name); err != nil {
-					c.delImage(c.current)
-				}
-			default:
-				errLg.Printf("Unrecognized command: %v", cmd)
+			c.exec(cmd)
+		case key := <-chans.key:
+			if cmd := c.promptKey(key); cmd != nil {
+				// Go through chans.ctl like any other command.
+				go func() { chans.ctl <- cmd }()
+			}
+		case ev := <-chans.fs:
+			c.fsEvent(ev)
+		case req := <-chans.remote:
+			if req.cmd != nil {
+				c.exec(req.cmd)
 			}
+			req.reply <- c.status()
+		case imgs := <-chans.files:
+			c.insert(imgs...)
+		case <-c.anim.tick:
+			c.animTick()
+		case <-c.msg.tick:
+			c.messageTick()
+		case d := <-c.done:
+			c.finished(d)
 		case pt := <-chans.panStartChan:
 			panStart = pt
 			panOrigin = c.origin
 		case pt := <-chans.panStepChan:
-			c.origin = show(c.i, panStart.Sub(pt).Add(panOrigin))
+			c.origin = c.show(panStart.Sub(pt).Add(panOrigin))
+		}
+	}
+}
+
+// exec runs a command, or each command of a sequence in turn.
+func (c *Canvas) exec(cmd cmd) {
+	if cmds := cmd.split(); len(cmds) != 1 {
+		for _, cmd := range cmds {
+			c.exec(cmd)
+		}
+		return
+	}
+
+	if n, ok := commands[cmd[0]]; ok && len(cmd)-1 < n {
+		errLg.Printf("Missing arguments: %v", cmd)
+		return
+	}
+	if c.help >= 0 && c.helpCmd(cmd) {
+		return
+	}
+
+	switch cmd[0] {
+	case "next":
+		c.setImage(c.current + 1)
+
+	case "prev":
+		c.setImage(c.current - 1)
+
+	case "goto":
+		n, err := strconv.Atoi(cmd[1])
+		if err != nil || n < 1 || n > len(c.imgs) {
+			errLg.Printf("Invalid image number: %v", cmd)
+			break
 		}
+		c.setImage(n - 1)
+
+	case "page":
+		n := c.i.vimage.pages
+		if n < 2 {
+			break
+		}
+		p := c.i.page
+		switch cmd[1] {
+		case "next":
+			p = (p + 1) % n
+		case "prev":
+			p = (p + n - 1) % n
+		default:
+			var err error
+			if p, err = strconv.Atoi(cmd[1]); err != nil || p < 1 || p > n {
+				errLg.Printf("Invalid page number: %v", cmd)
+				return
+			}
+			p--
+		}
+		c.i.page = p
+		sched.forget(c.i)
+		c.setImage(c.current)
+
+	// resize the window to fit the current image.
+	// Not needed since we are always full screen
+	// and if we arent fs, resize maybe should be automatic
+	//case "fit":
+	//	b := imgs[current].vimage.Bounds()
+	//	window.Resize(b.Dx(), b.Dy())
+	case "pan":
+		switch cmd[1] {
+		case "left":
+			c.origin.X -= flagIncrement
+		case "right":
+			c.origin.X += flagIncrement
+
+		// up and down are reversed, X origin is the top-left corner
+		case "up":
+			c.origin.Y -= flagIncrement
+		case "down":
+			c.origin.Y += flagIncrement
+		}
+		c.origin = c.show(c.origin)
+	case "zoom":
+		switch cmd[1] {
+		case "in":
+			c.setZoom(c.zoom * zoomStep)
+		case "out":
+			c.setZoom(c.zoom / zoomStep)
+		case "fit":
+			c.fit = true
+			c.origin = c.show(image.Point{0, 0})
+		case "1:1":
+			c.setZoom(1)
+		default:
+			z, err := strconv.ParseFloat(cmd[1], 64)
+			if err != nil || z <= 0 {
+				errLg.Printf("Invalid zoom factor: %v", cmd)
+				break
+			}
+			c.setZoom(z)
+		}
+	case "rotate", "flip":
+		t, ok := transforms[strings.Join(cmd, " ")]
+		if !ok {
+			errLg.Printf("Unrecognized command: %v", cmd)
+			break
+		}
+		c.transform(t)
+	case "play", "frame", "loop":
+		c.animCmd(cmd)
+	case "background":
+		c.background(strings.Join(cmd.Args(), " "))
+	case "mark":
+		c.markCmd(cmd.Args())
+	case "batch":
+		c.batch(cmd.Args())
+	case "each":
+		c.each(cmd.Args())
+	case "sort":
+		c.sort(cmd.Args())
+	case "prompt":
+		c.openPrompt()
+	case "help":
+		c.toggleHelp()
+	case "quit":
+		// Xgb bug prevents this from working?
+		// Anything wrong with calling os.Exit() directly? 
+		//xevent.Quit(window.X) 
+		stopRemote()
+		c.printMarks()
+		os.Exit(0)
+	case "!", "&":
+		c.external(cmd)
+	case "cancel":
+		c.cancelJobs()
+	default:
+		errLg.Printf("Unrecognized command: %v", cmd)
 	}
 }
 
-// originTrans translates the origin with respect to the current image and the
-// current canvas size. This makes sure we never incorrectly position the image.
+// originTrans translates the origin with respect to the size of the current
+// (scaled) image and the current canvas size. This makes sure we never
+// incorrectly position the image.
 // (i.e., panning never goes too far, and whenever the canvas is bigger than
 // the image, the origin is *always* (0, 0).
-func originTrans(pt image.Point, win *Window, img *vimage) image.Point {
+func originTrans(pt image.Point, win *Window, size image.Point) image.Point {
 	// Quick aliases.
 	ww, wh := win.Geom.Width(), win.Geom.Height()
-	dw := img.Bounds().Dx() - ww
-	dh := img.Bounds().Dy() - wh
+	dw := size.X - ww
+	dh := size.Y - wh
 
 	// Set the allowable range of the origin point of the image.
 	// i.e., never less than (0, 0) and never greater than the width/height
 	// of the image that isn't viewable at any given point (which is determined
 	// by the canvas size).
-	pt.X = min(img.Bounds().Min.X+dw, max(pt.X, 0))
-	pt.Y = min(img.Bounds().Min.Y+dh, max(pt.Y, 0))
+	pt.X = min(dw, max(pt.X, 0))
+	pt.Y = min(dh, max(pt.Y, 0))
 
 	// Validate origin point. If the width/height of an image is smaller than
 	// the canvas width/height, then the image origin cannot change in x/y
 	// direction.
-	if img.Bounds().Dx() < ww {
+	if size.X < ww {
 		pt.X = 0
 	}
-	if img.Bounds().Dy() < wh {
+	if size.Y < wh {
 		pt.Y = 0
 	}
 
 	return pt
 }
 
-func show(img *Img, pt image.Point) image.Point {
+// show paints the visible region of the current image, at the current zoom
+// level, with its top-left corner at pt (in scaled coordinates).
+func (c *Canvas) show(pt image.Point) image.Point {
+	vimg := c.i.vimage
+	if c.fit {
+		c.zoom = fitZoom(vimg.Bounds(), window)
+	}
+	size := scaledSize(vimg.Bounds(), c.zoom)
 
 	// Translate the origin to reflect the size of the image and canvas.
-	pt = originTrans(pt, window, img.vimage)
+	pt = originTrans(pt, window, size)
+	view := image.Rect(pt.X, pt.Y, pt.X+window.Geom.Width(), pt.Y+window.Geom.Height())
+
+	// Whatever was drawn over the image may not be covered by it.
+	for _, r := range c.overlays {
+		window.clear(r)
+	}
+	c.overlays = c.overlays[:0]
+
+	// Painting only paints the tiles that are viewable. When zoomed, only
+	// that region is scaled.
+	view = view.Intersect(image.Rectangle{Max: size})
+	if c.zoom == 1 {
+		c.shown, c.shownArea = nil, view
+		c.shownAt = window.margin(view.Size())
+		vimg.paint(view, c.shownAt)
+	} else {
+		c.shown = c.scaled(view)
+		c.shownArea = c.shown.Bounds()
+		c.shownAt = window.paint(c.shown)
+	}
+	sched.account(c.i)
 
-	// Painting only paints the sub-image that is viewable.
-	window.paint(img.vimage.SubImage(
-		image.Rect(pt.X, pt.Y, pt.X+window.Geom.Width(), pt.Y+window.Geom.Height())))
+	// Anything drawn on top of the image has to be painted again.
+	c.paintMark()
+	c.paintMessage()
+	c.paintPrompt()
+	c.paintHelp()
 
 	// Always set the name of the window when we update it with a new image.
-	window.setName(img.name)
+	name := c.i.name
+	if c.i.marked {
+		name += " (marked)"
+	}
+	switch {
+	case vimg.err != nil:
+		window.setName(fmt.Sprintf("%s - Error", name))
+	case vimg.pages > 1:
+		window.setName(fmt.Sprintf("%s [%d/%d]", name, c.i.page+1, vimg.pages))
+	default:
+		window.setName(name)
+	}
 
 	return pt
 }
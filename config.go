@@ -1,6 +1,16 @@
 package main
 
-const panIncrement = 20 // Increment (in pixels) used to pan the image.
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+const zoomStep = 1.25 // Factor applied by each zoom in/out step.
 
 type cmd []string
 
@@ -12,6 +22,97 @@ func (c cmd) Args() (args []string) {
 	return
 }
 
+// commands maps the name of every command understood by Canvas.exec to the
+// minimum number of arguments it takes.
+var commands = map[string]int{
+	"next":       0,
+	"prev":       0,
+	"goto":       1,
+	"page":       1,
+	"pan":        1,
+	"zoom":       1,
+	"rotate":     1,
+	"flip":       1,
+	"play":       0,
+	"frame":      1,
+	"loop":       1,
+	"mark":       0,
+	"batch":      1,
+	"each":       1,
+	"sort":       1,
+	"background": 0,
+	"prompt":     0,
+	"help":       0,
+	"quit":       0,
+	"!":          1,
+	"&":          1,
+	"cancel":     0,
+}
+
+// parseCmd splits a line into a command. Arguments are separated by white
+// space, unless quoted with single or double quotes. An unquoted ';' separates
+// commands in a sequence, see cmd.split. A '!' or '&' at the start of a
+// command is an argument on its own, so "!ls" is the same as "! ls".
+func parseCmd(line string) (c cmd, err error) {
+	var arg []rune
+	var quote rune
+	inArg, start := false, true
+	end := func() {
+		if inArg {
+			c = append(c, string(arg))
+			arg, inArg = arg[:0], false
+		}
+	}
+	for _, r := range line {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			arg = append(arg, r)
+		case r == '\'' || r == '"':
+			quote, inArg, start = r, true, false
+		case r == ';':
+			end()
+			c = append(c, ";")
+			start = true
+		case unicode.IsSpace(r):
+			end()
+		case (r == '!' || r == '&') && start:
+			c = append(c, string(r))
+			start = false
+		default:
+			arg, inArg, start = append(arg, r), true, false
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+	end()
+	if len(c.split()) == 0 {
+		return nil, fmt.Errorf("empty command")
+	}
+	return c, nil
+}
+
+// split splits a sequence of commands separated by ";" arguments, dropping
+// empty ones.
+func (c cmd) split() (cmds []cmd) {
+	for len(c) > 0 {
+		i := 0
+		for i < len(c) && c[i] != ";" {
+			i++
+		}
+		if i > 0 {
+			cmds = append(cmds, c[:i])
+		}
+		if i == len(c) {
+			break
+		}
+		c = c[i+1:]
+	}
+	return
+}
+
 // keyb represents a keybinding.
 type keyb struct {
 	key     string // key sequence
@@ -22,6 +123,7 @@ type keyb struct {
 // A list of keybindings. Each value corresponds to a triple of the key
 // sequence to bind to, the action to run when that key sequence is
 // pressed and a quick description of what the keybinding does.
+// The configuration file can change them, see loadConfig.
 var keybinds = []keyb{
 	{"left", cmd{"prev"}, "Cycle to the previous image."},
 	{"right", cmd{"next"}, "Cycle to the next image."},
@@ -30,11 +132,150 @@ var keybinds = []keyb{
 	{"shift-l", cmd{"next"}, "Cycle to the next image."},
 
 	//{"r", cmd{"fit"}, "Resize the window to fit the current image."},
+	{"]", cmd{"page", "next"}, "Show the next page of a multi-page image."},
+	{"[", cmd{"page", "prev"}, "Show the previous page of a multi-page image."},
+
 	{"shift-r", cmd{"!", "mv", "%", ".trash/"}, "Move file to .trash/."},
+	{"control-c", cmd{"cancel"}, "Kill the commands running in the background."},
+
+	{"t", cmd{"mark"}, "Mark or unmark the image."},
+	{"shift-t", cmd{"mark", "invert"}, "Invert the marks of all images."},
 
 	{"h", cmd{"pan", "left"}, "Pan left."},
 	{"j", cmd{"pan", "down"}, "Pan down."},
 	{"k", cmd{"pan", "up"}, "Pan up."},
 	{"l", cmd{"pan", "right"}, "Pan right."},
+	{":", cmd{"prompt"}, "Open the command line."},
+	{"?", cmd{"help"}, "Show or hide this help (j/k scroll it)."},
+
+	{"z", cmd{"zoom", "in"}, "Zoom in."},
+	{"x", cmd{"zoom", "out"}, "Zoom out."},
+	{"f", cmd{"zoom", "fit"}, "Zoom to fit the window."},
+	{"1", cmd{"zoom", "1:1"}, "Zoom to the original size."},
+
+	{"r", cmd{"rotate", "cw"}, "Rotate clockwise."},
+	{"e", cmd{"rotate", "ccw"}, "Rotate counter-clockwise."},
+	{"m", cmd{"flip", "h"}, "Flip horizontally (mirror)."},
+	{"shift-m", cmd{"flip", "v"}, "Flip vertically."},
+
+	{"b", cmd{"background"}, "Cycle through the background modes."},
+
+	{"space", cmd{"play"}, "Play or pause an animation."},
+	{".", cmd{"frame", "next"}, "Show the next frame of an animation."},
+	{",", cmd{"frame", "prev"}, "Show the previous frame of an animation."},
+
 	{"q", cmd{"quit"}, "Quit."},
 }
+
+// configPath returns the default location of the configuration file.
+func configPath() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		dir = filepath.Join(os.Getenv("HOME"), ".config")
+	}
+	return filepath.Join(dir, "vimg", "config")
+}
+
+// loadConfig reads the configuration file name. Each line holds one of
+//
+//	set <flag> <value>
+//	bind <key> <command> [; <command> ...]
+//	unbind <key>
+//
+// Blank lines and lines starting with '#' are ignored. 'set' takes the name of
+// any command line flag (without dashes), flags given on the command line win
+// over the configuration file. 'bind' replaces any previous binding of key,
+// commands are parsed as in the command line.
+//
+// Errors are reported with their line number and the offending lines
+// skipped. A missing file is only an error if missingOk is false.
+func loadConfig(name string, missingOk bool) {
+	f, err := os.Open(name)
+	if err != nil {
+		if !missingOk || !os.IsNotExist(err) {
+			errLg.Print(err)
+		}
+		return
+	}
+	defer f.Close()
+
+	// Flags given on the command line.
+	given := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		if err := configLine(s.Text(), given); err != nil {
+			errLg.Printf("%s:%d: %s", name, n, err)
+		}
+	}
+	if err := s.Err(); err != nil {
+		errLg.Printf("%s: %s", name, err)
+	}
+}
+
+// configLine applies a single line of the configuration file.
+func configLine(line string, given map[string]bool) error {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil
+	}
+	fields := strings.Fields(line)
+	directive, args := fields[0], strings.TrimSpace(line[len(fields[0]):])
+
+	switch directive {
+	case "set":
+		if len(fields) != 3 {
+			return fmt.Errorf("usage: set <flag> <value>")
+		}
+		f := flag.Lookup(fields[1])
+		if f == nil {
+			return fmt.Errorf("unknown flag '%s'", fields[1])
+		}
+		if given[f.Name] {
+			return nil
+		}
+		// Some flag types clobber the value even if they fail.
+		old := f.Value.String()
+		if err := f.Value.Set(fields[2]); err != nil {
+			f.Value.Set(old)
+			return fmt.Errorf("invalid value for '%s': %s", f.Name, err)
+		}
+	case "bind":
+		if len(fields) < 3 {
+			return fmt.Errorf("usage: bind <key> <command>")
+		}
+		key := fields[1]
+		line := strings.TrimSpace(args[len(key):])
+		c, err := parseCmd(line)
+		if err != nil {
+			return err
+		}
+		for _, part := range c.split() {
+			if _, ok := commands[part[0]]; !ok {
+				return fmt.Errorf("unknown command '%s'", part[0])
+			}
+		}
+		unbind(key)
+		keybinds = append(keybinds, keyb{key, c, line})
+	case "unbind":
+		if len(fields) != 2 {
+			return fmt.Errorf("usage: unbind <key>")
+		}
+		unbind(fields[1])
+	default:
+		return fmt.Errorf("unknown directive '%s'", directive)
+	}
+	return nil
+}
+
+// unbind removes every binding of key.
+func unbind(key string) {
+	kbs := keybinds[:0]
+	for _, kb := range keybinds {
+		if kb.key != key {
+			kbs = append(kbs, kb)
+		}
+	}
+	keybinds = kbs
+}
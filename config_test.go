@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParseCmd(t *testing.T) {
+	for _, tt := range []struct {
+		line string
+		want string // The commands of the sequence, or the error.
+	}{
+		{"next", `[[next]]`},
+		{"  zoom   in ", `[[zoom in]]`},
+		{"\tgoto\t12\n", `[[goto 12]]`},
+
+		// Quoting.
+		{`sort 'natural' "reverse"`, `[[sort natural reverse]]`},
+		{`! mv % "/tmp/my pictures"`, `[[! mv % /tmp/my pictures]]`},
+		{`! echo "it's" 'say "hi"'`, `[[! echo it's say "hi"]]`},
+		{`! echo a'b c'd`, `[[! echo ab cd]]`},
+		{`! touch '' x`, `[[! touch  x]]`},
+		{`! echo "a;b"`, `[[! echo a;b]]`},
+		{`! echo '!'`, `[[! echo !]]`},
+		{`! echo "unterminated`, `error: unterminated quote`},
+		{`next 'x`, `error: unterminated quote`},
+
+		// Sequences.
+		{"next;next", `[[next] [next]]`},
+		{"zoom fit ; rotate cw", `[[zoom fit] [rotate cw]]`},
+		{"next;;prev;", `[[next] [prev]]`},
+		{"; next", `[[next]]`},
+		{"", `error: empty command`},
+		{"   ", `error: empty command`},
+		{" ; ;", `error: empty command`},
+
+		// External commands.
+		{"!ls -l", `[[! ls -l]]`},
+		{"! ls -l", `[[! ls -l]]`},
+		{"&gimp %", `[[& gimp %]]`},
+		{"  & gimp %", `[[& gimp %]]`},
+		{"!", `[[!]]`},
+		{"next;!rm %;&sync", `[[next] [! rm %] [& sync]]`},
+		{"zoom in; ! echo done", `[[zoom in] [! echo done]]`},
+		{"!echo a!b &c", `[[! echo a!b &c]]`},
+		{"!!x", `[[! !x]]`},
+		{"mark&", `[[mark&]]`},
+		{`"!ls"`, `[[!ls]]`},
+	} {
+		c, err := parseCmd(tt.line)
+		got := fmt.Sprint(c.split())
+		if err != nil {
+			got = "error: " + err.Error()
+		}
+		if got != tt.want {
+			t.Errorf("parseCmd(%q) = %s, want %s", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestCmdSplit(t *testing.T) {
+	for _, tt := range []struct {
+		c    cmd
+		want string
+	}{
+		{nil, `[]`},
+		{cmd{"next"}, `[[next]]`},
+		{cmd{";"}, `[]`},
+		{cmd{"zoom", "in", ";", "next"}, `[[zoom in] [next]]`},
+		{cmd{";", ";", "next", ";", ";", "prev", ";"}, `[[next] [prev]]`},
+	} {
+		if got := fmt.Sprint(tt.c.split()); got != tt.want {
+			t.Errorf("%q.split() = %s, want %s", tt.c, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"runtime"
+	"sync"
+
+	"github.com/BurntSushi/xgbutil/xgraphics"
+)
+
+// Conversion to BGRA is where most of the time goes when an image is shown,
+// so the common image types get their own loops working on the Pix slices
+// instead of going through the image.Image interface, and the rows are split
+// in bands converted in parallel. Images with transparent parts are blended
+// into the background row by row, while the row is still hot.
+
+const minBand = 64 // Rows below which a band is not split any further.
+
+// checker is the background that images with an alpha channel are blended
+// into.
+type checker struct {
+	size        int // Width and height of the squares, in pixels.
+	light, dark xgraphics.BGRA
+}
+
+// blend blends the row of premultiplied BGRA pixels d, whose first pixel is
+// at (x, y) of the image, into the background.
+func (ck *checker) blend(d []uint8, x, y int) {
+	odd := y/ck.size%2 == 1
+	for i := 0; i < len(d); i += 4 {
+		a := uint32(d[i+3])
+		if a == 0xff {
+			continue
+		}
+		c := ck.light
+		if ((x+i/4)/ck.size%2 == 1) != odd {
+			c = ck.dark
+		}
+		na := 0xff - a
+		d[i] = uint8(min(0xff, int(uint32(d[i])+uint32(c.B)*na/0xff)))
+		d[i+1] = uint8(min(0xff, int(uint32(d[i+1])+uint32(c.G)*na/0xff)))
+		d[i+2] = uint8(min(0xff, int(uint32(d[i+2])+uint32(c.R)*na/0xff)))
+		d[i+3] = 0xff
+	}
+}
+
+// convert fills dst with the pixels of src, starting at pt, in BGRA. If ck is
+// not nil, they are blended into it.
+func convert(dst *xgraphics.Image, src image.Image, pt image.Point, ck *checker) {
+	b := dst.Bounds()
+	bands := max(1, min(runtime.NumCPU(), b.Dy()/minBand))
+	row := rowConverter(src)
+
+	var wg sync.WaitGroup
+	for i := 0; i < bands; i++ {
+		y0, y1 := b.Min.Y+b.Dy()*i/bands, b.Min.Y+b.Dy()*(i+1)/bands
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// The checkered background starts at the top-left corner of src.
+			sb := src.Bounds()
+			for y := y0; y < y1; y++ {
+				d := dst.Pix[dst.PixOffset(b.Min.X, y):][:4*b.Dx()]
+				sy := pt.Y + y - b.Min.Y
+				row(d, pt.X, sy)
+				if ck != nil {
+					ck.blend(d, pt.X-sb.Min.X, sy-sb.Min.Y)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// rowConverter returns a function that converts len(d)/4 pixels of src,
+// starting at (x, y), into d.
+func rowConverter(src image.Image) func(d []uint8, x, y int) {
+	switch src := src.(type) {
+	case *image.RGBA:
+		return func(d []uint8, x, y int) {
+			s := src.Pix[src.PixOffset(x, y):]
+			for i := 0; i < len(d); i += 4 {
+				d[i], d[i+1], d[i+2], d[i+3] = s[i+2], s[i+1], s[i], s[i+3]
+			}
+		}
+
+	case *image.NRGBA:
+		// X wants premultiplied alpha, computed like color.NRGBA.RGBA.
+		return func(d []uint8, x, y int) {
+			s := src.Pix[src.PixOffset(x, y):]
+			for i := 0; i < len(d); i += 4 {
+				a := uint32(s[i+3])
+				if a == 0xff {
+					d[i], d[i+1], d[i+2], d[i+3] = s[i+2], s[i+1], s[i], 0xff
+					continue
+				}
+				d[i] = uint8(uint32(s[i+2]) * 0x101 * a / 0xff >> 8)
+				d[i+1] = uint8(uint32(s[i+1]) * 0x101 * a / 0xff >> 8)
+				d[i+2] = uint8(uint32(s[i]) * 0x101 * a / 0xff >> 8)
+				d[i+3] = uint8(a)
+			}
+		}
+
+	case *image.Gray:
+		return func(d []uint8, x, y int) {
+			s := src.Pix[src.PixOffset(x, y):]
+			for i := 0; i < len(d)/4; i++ {
+				d[4*i], d[4*i+1], d[4*i+2], d[4*i+3] = s[i], s[i], s[i], 0xff
+			}
+		}
+
+	case *image.Paletted:
+		var pal [256][4]uint8
+		for i, c := range src.Palette {
+			r, g, b, a := c.RGBA()
+			pal[i] = [4]uint8{uint8(b >> 8), uint8(g >> 8), uint8(r >> 8), uint8(a >> 8)}
+		}
+		return func(d []uint8, x, y int) {
+			s := src.Pix[src.PixOffset(x, y):]
+			for i := 0; i < len(d)/4; i++ {
+				copy(d[4*i:4*i+4], pal[s[i]][:])
+			}
+		}
+
+	case *image.YCbCr:
+		return yCbCrConverter(src)
+	}
+
+	return func(d []uint8, x, y int) {
+		for i := 0; i < len(d)/4; i++ {
+			r, g, b, a := src.At(x+i, y).RGBA()
+			d[4*i], d[4*i+1], d[4*i+2], d[4*i+3] =
+				uint8(b>>8), uint8(g>>8), uint8(r>>8), uint8(a>>8)
+		}
+	}
+}
+
+// yCbCrConverter is rowConverter for YCbCr images. The chroma samples are
+// found by shifting the coordinates, which works for every subsample ratio.
+func yCbCrConverter(src *image.YCbCr) func(d []uint8, x, y int) {
+	var hs, vs uint // Horizontal and vertical chroma subsampling shifts.
+	switch src.SubsampleRatio {
+	case image.YCbCrSubsampleRatio422:
+		hs = 1
+	case image.YCbCrSubsampleRatio420:
+		hs, vs = 1, 1
+	case image.YCbCrSubsampleRatio440:
+		vs = 1
+	case image.YCbCrSubsampleRatio411:
+		hs = 2
+	case image.YCbCrSubsampleRatio410:
+		hs, vs = 2, 1
+	}
+
+	sr := src.Rect
+	return func(d []uint8, x, y int) {
+		yi := (y-sr.Min.Y)*src.YStride - sr.Min.X
+		ci := (y>>vs-sr.Min.Y>>vs)*src.CStride - sr.Min.X>>hs
+		for i := 0; i < len(d)/4; i++ {
+			xs := x + i
+			c := ci + xs>>hs
+			r, g, b := color.YCbCrToRGB(src.Y[yi+xs], src.Cb[c], src.Cr[c])
+			d[4*i], d[4*i+1], d[4*i+2], d[4*i+3] = b, g, r, 0xff
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/BurntSushi/xgbutil"
+	"github.com/BurntSushi/xgbutil/xgraphics"
+)
+
+// generic hides the type of an image, so that rowConverter falls back to
+// At().RGBA().
+type generic struct{ image.Image }
+
+func randomPix(rnd *rand.Rand, b []uint8) {
+	for i := range b {
+		b[i] = uint8(rnd.Intn(256))
+	}
+}
+
+// testImages returns images of every type with a specialized converter, with
+// random pixels in r.
+func testImages(r image.Rectangle) map[string]image.Image {
+	rnd := rand.New(rand.NewSource(1))
+	ims := map[string]image.Image{}
+
+	rgba := image.NewRGBA(r)
+	randomPix(rnd, rgba.Pix)
+	for i := 0; i < len(rgba.Pix); i += 4 {
+		// Premultiplied colors can't exceed their alpha.
+		for k := 0; k < 3; k++ {
+			if rgba.Pix[i+k] > rgba.Pix[i+3] {
+				rgba.Pix[i+k] = rgba.Pix[i+3]
+			}
+		}
+	}
+	ims["RGBA"] = rgba
+
+	nrgba := image.NewNRGBA(r)
+	randomPix(rnd, nrgba.Pix)
+	ims["NRGBA"] = nrgba
+
+	gray := image.NewGray(r)
+	randomPix(rnd, gray.Pix)
+	ims["Gray"] = gray
+
+	pal := image.NewPaletted(r, color.Palette{
+		color.Black, color.White, color.NRGBA{10, 200, 30, 128}, color.Transparent})
+	for i := range pal.Pix {
+		pal.Pix[i] = uint8(rnd.Intn(len(pal.Palette)))
+	}
+	ims["Paletted"] = pal
+
+	for name, ratio := range map[string]image.YCbCrSubsampleRatio{
+		"YCbCr444": image.YCbCrSubsampleRatio444,
+		"YCbCr422": image.YCbCrSubsampleRatio422,
+		"YCbCr420": image.YCbCrSubsampleRatio420,
+		"YCbCr440": image.YCbCrSubsampleRatio440,
+		"YCbCr411": image.YCbCrSubsampleRatio411,
+		"YCbCr410": image.YCbCrSubsampleRatio410,
+	} {
+		y := image.NewYCbCr(r, ratio)
+		randomPix(rnd, y.Y)
+		randomPix(rnd, y.Cb)
+		randomPix(rnd, y.Cr)
+		ims[name] = y
+	}
+	return ims
+}
+
+// newBGRA returns a destination for convert. xgraphics.New would connect to X
+// to create it.
+func newBGRA(r image.Rectangle) *xgraphics.Image {
+	return &xgraphics.Image{Pix: make([]uint8, 4*r.Dx()*r.Dy()), Stride: 4 * r.Dx(), Rect: r}
+}
+
+type subImager interface {
+	SubImage(r image.Rectangle) image.Image
+}
+
+func TestConvert(t *testing.T) {
+	ims := testImages(image.Rect(3, 7, 303, 207))
+	subs := map[string]image.Image{}
+	for name, im := range ims {
+		// A sub-image, with odd offsets into the subsampled chroma.
+		subs[name+"/sub"] = im.(subImager).SubImage(image.Rect(17, 21, 250, 190))
+	}
+	for name, im := range subs {
+		ims[name] = im
+	}
+
+	for name, im := range ims {
+		b := im.Bounds()
+		pt := b.Min.Add(image.Pt(5, 3))
+		r := image.Rect(0, 0, b.Dx()-10, b.Dy()-5)
+		for _, ck := range []*checker{nil, {8, xgraphics.BGRA{B: 0xcc, G: 0xcc, R: 0xcc, A: 0xff}, xgraphics.BGRA{B: 0x20, G: 0x10, R: 0x40, A: 0xff}}} {
+			got, want := newBGRA(r), newBGRA(r)
+			convert(got, im, pt, ck)
+			convert(want, generic{im}, pt, ck)
+			for i := range got.Pix {
+				if d := int(got.Pix[i]) - int(want.Pix[i]); d < -1 || d > 1 {
+					x, y := i/4%r.Dx(), i/4/r.Dx()
+					t.Errorf("%s (checker %v): pixel (%d, %d) is %v, want %v", name, ck != nil,
+						x, y, got.Pix[i&^3:][:4], want.Pix[i&^3:][:4])
+					break
+				}
+			}
+		}
+	}
+}
+
+var benchImages map[string]image.Image
+
+func benchImage(name string) image.Image {
+	if benchImages == nil {
+		benchImages = testImages(image.Rect(0, 0, 1920, 1080))
+	}
+	return benchImages[name]
+}
+
+func benchmarkConvert(b *testing.B, name string, wrap func(image.Image) image.Image) {
+	im := wrap(benchImage(name))
+	dst := newBGRA(im.Bounds())
+	b.SetBytes(int64(len(dst.Pix)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		convert(dst, im, im.Bounds().Min, nil)
+	}
+}
+
+// benchmarkNewConvert measures xgraphics.NewConvert, which vimg used before it
+// had its own conversion. The X connection is only stored in the image.
+func benchmarkNewConvert(b *testing.B, name string) {
+	im := benchImage(name)
+	// It logs every image of a type it has no loop for.
+	xgbutil.Logger.SetOutput(ioutil.Discard)
+	defer xgbutil.Logger.SetOutput(os.Stderr)
+	X := &xgbutil.XUtil{}
+	b.SetBytes(int64(4 * im.Bounds().Dx() * im.Bounds().Dy()))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		xgraphics.NewConvert(X, im)
+	}
+}
+
+func specialized(im image.Image) image.Image { return im }
+func atRGBA(im image.Image) image.Image      { return generic{im} }
+
+func BenchmarkConvertRGBA(b *testing.B)     { benchmarkConvert(b, "RGBA", specialized) }
+func BenchmarkConvertNRGBA(b *testing.B)    { benchmarkConvert(b, "NRGBA", specialized) }
+func BenchmarkConvertGray(b *testing.B)     { benchmarkConvert(b, "Gray", specialized) }
+func BenchmarkConvertPaletted(b *testing.B) { benchmarkConvert(b, "Paletted", specialized) }
+func BenchmarkConvertYCbCr(b *testing.B)    { benchmarkConvert(b, "YCbCr420", specialized) }
+func BenchmarkConvertGeneric(b *testing.B)  { benchmarkConvert(b, "YCbCr420", atRGBA) }
+
+func BenchmarkNewConvertRGBA(b *testing.B)     { benchmarkNewConvert(b, "RGBA") }
+func BenchmarkNewConvertNRGBA(b *testing.B)    { benchmarkNewConvert(b, "NRGBA") }
+func BenchmarkNewConvertGray(b *testing.B)     { benchmarkNewConvert(b, "Gray") }
+func BenchmarkNewConvertPaletted(b *testing.B) { benchmarkNewConvert(b, "Paletted") }
+func BenchmarkNewConvertYCbCr(b *testing.B)    { benchmarkNewConvert(b, "YCbCr420") }
@@ -1,22 +1,108 @@
 /*
 VImg is a simple image viewer that only works with X and is written in Go. It 
-supports image formats that can be decoded by the Go standard library 
-(currently jpeg, gif and png). It supports panning the image but does not (yet) 
-support zooming.
+supports jpeg, gif and png (decoded by the Go standard library), bmp, tiff and 
+webp (decoded by golang.org/x/image) and the Netpbm formats (pbm, pgm and ppm). 
+It supports panning and zooming the image.
 
 Usage:
 	vimg [flags] image-file [image-file ...]
+	find ... | vimg -i [flags] [image-file ...]
+	vimg [--socket path] --remote [command]
+
+Arguments can be image files or directories. Only the files whose contents 
+look like a supported image format are shown, whatever their extension. Images 
+that cannot be loaded stay in the list, shown as a card with the error. Zip 
+(and cbz) and tar (or gzipped tar) archives are shown like directories: each 
+image in them, in natural order, is named after the archive and its path 
+inside it (e.g. 'comic.cbz:page01.png') and is only read when it is shown. An 
+argument of '-' reads an image piped on stdin (which can't be combined with -i 
+or -0); it is never written back, nor handed to external commands.
 
 The flags are:
 	--height pixels, --width pixels
 		The 'height' and 'width' flags allow one to specify the initial size
 		of the image window. The image window can still change size afterwards.
+		If neither is given, the window is full screen.
 	--increment pixels
 		The amount of pixels to pan an image at each step when using the 
 		keyboard shortcuts.
 	--keybindings
 		If set, a list of all key bindings (and mouse bindings) set by vimg is
 		printed. A small description of what each key binding does is included.
+	--config file
+		Read the configuration from file instead of the default
+		$XDG_CONFIG_HOME/vimg/config (or ~/.config/vimg/config).
+	--background #rrggbb
+		The color of the window around the image.
+	--background-mode mode
+		What shows through the transparent parts of images: 'checker' (the
+		default) a checkered background, 'solid' the --background color and
+		'black' black, for the window around the image too. 'b' cycles
+		through the modes, and ':background mode' switches to one of them.
+	--checker-size pixels, --checker-light #rrggbb, --checker-dark #rrggbb
+		In checker mode, images with transparent parts are shown over squares
+		of this size and colors (15 pixels, white and light grey by default).
+		Opaque images are not blended at all.
+	--sort order
+		Sort the images by 'name', 'natural' (like name, but numbers are
+		compared by value so img2 comes before img10), 'mtime', 'size',
+		'exif' (the date the picture was taken, or mtime if unknown) or
+		'shuffle' them. 'none', the default, keeps them in the order they
+		were found. The list can be sorted again with the 'sort' command.
+	--reverse
+		Reverse the sort order.
+	-r, --recursive
+		Look for images in the subdirectories of the directories given, too.
+	-i, -0
+		Also read the names of images (or directories) from stdin, one per 
+		line with -i or separated by NUL characters with -0 (as written by 
+		find -print0). The first image is shown as soon as it is read, the 
+		others are added to the list as they come. Files named on stdin are 
+		not watched for changes.
+	--depth levels
+		With -r, do not go more than this many levels below the directories
+		given. 0 (the default) means no limit.
+	--include glob, --exclude glob
+		Only show the files whose name matches the glob, or skip the files and
+		directories whose name matches it. Both can be given several times.
+	--include-re regexp, --exclude-re regexp
+		Same as --include and --exclude, but with a regular expression matched
+		against the whole path.
+	--cache megabytes
+		The amount of memory used to keep loaded images around. When it is
+		exceeded, the images farthest from the current one are freed and
+		loaded again if they are shown later.
+	--write
+		If set, rotating or flipping an image also saves the result back to
+		its file, encoded in its original format. JPEG, PNG, GIF, BMP and
+		single-page TIFF files can be written.
+	--noexif
+		By default, JPEG images are rotated according to the Orientation tag
+		of their Exif data. If set, images are shown as they are stored.
+	--nowatch
+		By default (on Linux), images are reloaded when their file changes,
+		removed from the list when it is deleted, and new images written to
+		the directories given (and, with -r, to new subdirectories) are added
+		to the list. If set, vimg does not watch for changes.
+	-o
+		On quit, print the names of the marked images to stdout (see Marks), 
+		one per line, e.g. 'vimg -o dir | xargs rm'.
+	--print0
+		With -o, end each name with a NUL character instead of a newline, 
+		for 'xargs -0'.
+	--jobs n
+		The number of commands ':each' runs at the same time (default the
+		number of CPUs), see External commands.
+	--timeout duration
+		Kill external commands that run for longer than this (default 10m, 
+		0 for no limit).
+	--socket path
+		The Unix socket vimg listens on for commands (default 
+		$XDG_RUNTIME_DIR/vimg.sock), see Remote control. If empty, vimg 
+		does not listen.
+	--remote
+		If set, vimg sends the command given (or each line read from stdin) 
+		to the instance listening on --socket, prints its replies and exits.
 	-v
 		If set, more output will be printed to stderr. Useful for debugging.
 	--profile prof-file-name
@@ -26,16 +112,104 @@ The flags are:
 Details
 
 VImg is about as simple as it gets for an image viewer. It only supports
-displaying the image and panning around the image when parts of it are not
-viewable. It does not support zooming or any kind of image manipulation.
+displaying the image, zooming and panning around the image when parts of it are
+not viewable. It does not support any kind of image manipulation.
+
+My primary future goal is to increase performance. (I'll rely on the Go
+standard library to write new image format decoders).
+
+Multi-page images
+
+The pages of a multi-page tiff file are shown one at a time, ']' and '[' go to 
+the next and previous page, and ':page n' to page n. The window title shows 
+the current page and the number of pages.
+
+Animations
+
+Animated gifs are played as they are shown, as many times as the file says. 
+Space pauses and resumes playback, '.' and ',' step to the next and previous 
+frame (pausing it). ':frame n' shows frame n, ':loop n' plays animations n 
+times, ':loop forever' loops them forever and ':loop file' goes back to what 
+the file says.
+
+Marks
+
+'t' marks (or unmarks) the image shown, which is then labelled "Marked" in 
+the corner of the window and in its title. 'shift-t' inverts the marks of all 
+images, ':mark all' and ':mark none' mark or unmark them all. Marks are not 
+saved anywhere, but with -o the file names of the marked images are printed 
+when vimg quits (images read from stdin or from archives have none, and are 
+left out).
+
+Command line
+
+Pressing ':' opens a command line at the bottom of the window. Any command that 
+can be bound to a key can be typed there, e.g. ':goto 40', ':zoom 2' or 
+':! convert % -resize 50% %' (where '%' is replaced by the current file name). 
+Arguments with spaces can be quoted. Tab completes command names, Up and Down 
+browse the history, Return runs the command and Escape closes the command line.
+
+External commands
+
+'!' runs a command on the current image (an argument '%' is replaced by its 
+file name) and waits for it to exit, '&' runs it in the background instead: 
+vimg can be used in the meantime, and 'control-c' (':cancel') kills the 
+commands still running. Either way, whether the command succeeded and the end 
+of its output are shown at the bottom of the window for a few seconds. ':batch 
+command' runs a command once on the marked images (or the current one if none 
+is marked): an argument '%' (or '%s') is replaced by all their file names, 
+which are added at the end if there is none, and '%%' by '%'. ':each command' 
+runs it once per marked image, with the file name added at the end if it is 
+not in the arguments, up to --jobs at a time (':each -j 4 command' to choose). 
+Both run in the background like '&', and ':cancel' kills them too. In the 
+arguments of 'each', '%' (or '%s') is replaced by the file name, '%d' by its 
+directory, '%b' by its base name without extension, '%e' by its extension and 
+'%%' by '%', e.g.:
 
-My two primary future goals are to support zooming and to increase 
-performance.  (I'll rely on the Go standard library to write new image format 
-decoders).
+	:each convert % -resize 50% %d/small-%b%e
+	:batch mv %s keep/
 
-I didn't include zooming in the initial release because it adds a surprising 
-amount of complexity and has broad-sweeping performance implications depending 
-upon its implementation.
+Failures are reported for each file. Afterwards, images whose file is gone are 
+dropped from the list, and the others are loaded again.
+
+Remote control
+
+Every line written to the socket vimg listens on is run as a command, as if 
+typed in the command line, and answered with a line of JSON holding the status 
+of the viewer: whether the command was run ("ok", and "error" when it was not), 
+the current image ("image", "index" counted from 1, "count", "width", "height", 
+"zoom", "page" and "pages" for multi-page images, "marked", "image_error" when 
+it could not be loaded) and the number of marked images ("marks"). An empty 
+line, or 'status', only asks for the status. From a shell script:
+
+	vimg --remote goto 12
+	vimg --remote 'next; zoom fit'
+	printf 'pan left\npan left\n' | vimg --remote
+
+The exit status of --remote is not zero if a command failed.
+
+Configuration
+
+The configuration file is read at start up. Each line is one of:
+
+	set <flag> <value>
+	bind <key> <command> [; <command> ...]
+	unbind <key>
+
+Blank lines and lines starting with '#' are ignored. 'set' sets any of the 
+flags above (named without dashes); flags given on the command line take 
+precedence. 'bind' replaces the bindings of key with a command, or a sequence 
+of commands separated by ';', written as in the command line. Keys are named 
+as in the output of --keybindings, e.g.:
+
+	set increment 50
+	set background #000000
+	set cache 1024
+	bind n next
+	bind shift-d ! mv % .trash/ ; next
+	unbind q
+
+Errors are reported with the line they were found in, and the line skipped.
 
 High-level overview
 
@@ -71,7 +245,10 @@ Conversion to the xgbutil/xgraphics.Image type is, by far, the bottleneck. The
 process includes transforming every pixel in the decoded image to the correct 
 image byte order (currently BGRA), which is the format expected by X (in common 
 configurations). While this is fairly quick for small images, it can be quite 
-slow for larger images.
+slow for larger images. vimg has its own conversion loops for the most common 
+image types (YCbCr, RGBA, NRGBA, Paletted and Gray), working on the pixel data 
+directly instead of through the image.Image interface, and splitting the rows 
+among the CPUs. convert_test.go benchmarks them against xgraphics.NewConvert.
 
 The ideal solution, assuming image conversion itself cannot be sped up, seems 
 to be to process image conversions in the background with the hope that they 
@@ -88,6 +265,14 @@ at the cost of increased complexity but is probably the most performant
 solution. (The complexity lay in splitting conversion up into pieces, and 
 triggering the appropriate conversion when the image is panned.)
 
+This is what vimg does now: decoded images are kept as they are, and split in 
+tiles of 256x256 pixels that are converted (blended, rotated and flipped) when 
+they are first shown, and drawn to their own X pixmap when they are first 
+painted. The preloaders convert the tiles of the top-left corner in advance. 
+Panning only converts the tiles that come into view, and the least recently 
+used tiles are dropped when an image uses more than a quarter of the --cache 
+memory for them.
+
 As for drawing the image to an X pixmap, I was surprised to see that this was 
 fairly quick by comparison. It uses Go's built in copy function, which I 
 suspect is the source of its speediness.
@@ -113,6 +298,11 @@ speedy, but also for memory usage. (Keeping several different scaled and
 complete versions of a large image can use a ton of memory. With only a few 
 images like this, memory usage adds up quickly.)
 
+This is what vimg does: the zoom factor is kept by the canvas, and every time 
+the window is painted only the visible region is sampled (nearest neighbour) 
+into a viewport sized buffer. The cost of zooming is then bounded by the size 
+of the window, not by the size of the image.
+
 Perhaps another option is write a scaling routine that optimizes the use of 
 interfaces out of the performance critical sections. Doing this for image 
 conversion achieved 50-80% speed ups. (I don't think graphics-go does this 
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// A tiny Exif reader, just enough to find the few tags vimg cares about in
+// the APP1 segment of a JPEG file.
+
+const (
+	exifOrientation      = 0x0112
+	exifDateTime         = 0x0132
+	exifIFDPointer       = 0x8769
+	exifDateTimeOriginal = 0x9003
+)
+
+// orientations maps Exif orientation values to the transforms (applied in
+// order) needed to show the image the right way up.
+var orientations = map[int][]transform{
+	2: {flipH},
+	3: {rotateCW, rotateCW},
+	4: {flipV},
+	5: {flipH, rotateCCW},
+	6: {rotateCW},
+	7: {flipH, rotateCW},
+	8: {rotateCCW},
+}
+
+// exif holds the TIFF structure embedded in an Exif segment.
+type exif struct {
+	order binary.ByteOrder
+	seg   []byte // The whole APP1 segment, without its marker and length.
+	tiff  []byte // Part of seg.
+}
+
+// readExif scans the markers of a JPEG stream until it finds the Exif APP1
+// segment. It returns nil if r is not a JPEG or has no (valid) Exif data.
+func readExif(r io.Reader) *exif {
+	br := bufio.NewReader(r)
+	var hdr [4]byte
+	if _, err := io.ReadFull(br, hdr[:2]); err != nil || hdr[0] != 0xff || hdr[1] != 0xd8 {
+		return nil
+	}
+
+	for {
+		if _, err := io.ReadFull(br, hdr[:]); err != nil || hdr[0] != 0xff {
+			return nil
+		}
+		// Start of scan, metadata comes before it.
+		if hdr[1] == 0xda {
+			return nil
+		}
+		n := int(binary.BigEndian.Uint16(hdr[2:])) - 2
+		if n < 0 {
+			return nil
+		}
+		if hdr[1] != 0xe1 {
+			if _, err := br.Discard(n); err != nil {
+				return nil
+			}
+			continue
+		}
+
+		seg := make([]byte, n)
+		if _, err := io.ReadFull(br, seg); err != nil {
+			return nil
+		}
+		if !bytes.HasPrefix(seg, []byte("Exif\x00\x00")) {
+			continue
+		}
+		x := &exif{seg: seg, tiff: seg[6:]}
+		if len(x.tiff) < 8 {
+			return nil
+		}
+		switch string(x.tiff[:2]) {
+		case "II":
+			x.order = binary.LittleEndian
+		case "MM":
+			x.order = binary.BigEndian
+		default:
+			return nil
+		}
+		return x
+	}
+}
+
+// entry returns the type, count and value (or value offset) fields of tag in
+// the IFD at offset ifd.
+func (x *exif) entry(ifd uint32, tag uint16) (typ uint16, count uint32, val []byte, ok bool) {
+	if int(ifd)+2 > len(x.tiff) {
+		return
+	}
+	n := int(x.order.Uint16(x.tiff[ifd:]))
+	for i := 0; i < n; i++ {
+		off := int(ifd) + 2 + i*12
+		if off+12 > len(x.tiff) {
+			return
+		}
+		e := x.tiff[off : off+12]
+		if x.order.Uint16(e) == tag {
+			return x.order.Uint16(e[2:]), x.order.Uint32(e[4:]), e[8:12], true
+		}
+	}
+	return
+}
+
+// ifd0 returns the offset of the first IFD.
+func (x *exif) ifd0() uint32 {
+	return x.order.Uint32(x.tiff[4:])
+}
+
+// orientation returns the value of the Orientation tag, 1 (normal) if it is
+// missing or invalid.
+func (x *exif) orientation() int {
+	if x == nil {
+		return 1
+	}
+	typ, _, val, ok := x.entry(x.ifd0(), exifOrientation)
+	if !ok || typ != 3 { // SHORT
+		return 1
+	}
+	o := int(x.order.Uint16(val))
+	if o < 1 || o > 8 {
+		return 1
+	}
+	return o
+}
+
+// setOrientation changes the value of the Orientation tag, if there is one.
+func (x *exif) setOrientation(o int) {
+	if typ, _, val, ok := x.entry(x.ifd0(), exifOrientation); ok && typ == 3 {
+		x.order.PutUint16(val, uint16(o))
+	}
+}
+
+// dateTime returns when the picture was taken, or when the file was last
+// changed by the camera if that is missing.
+func (x *exif) dateTime() (time.Time, bool) {
+	if x == nil {
+		return time.Time{}, false
+	}
+	if typ, _, val, ok := x.entry(x.ifd0(), exifIFDPointer); ok && typ == 4 { // LONG
+		if t, ok := x.time(x.order.Uint32(val), exifDateTimeOriginal); ok {
+			return t, true
+		}
+	}
+	return x.time(x.ifd0(), exifDateTime)
+}
+
+// time reads the date and time stored in tag of the IFD at offset ifd.
+func (x *exif) time(ifd uint32, tag uint16) (time.Time, bool) {
+	typ, count, val, ok := x.entry(ifd, tag)
+	if !ok || typ != 2 || count < 19 { // ASCII, "YYYY:MM:DD HH:MM:SS\x00"
+		return time.Time{}, false
+	}
+	off := int(x.order.Uint32(val))
+	if off+19 > len(x.tiff) {
+		return time.Time{}, false
+	}
+	t, err := time.Parse("2006:01:02 15:04:05", string(x.tiff[off:off+19]))
+	return t, err == nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// exifTags are the tags written to a test Exif segment, zero values are left
+// out.
+type exifTags struct {
+	orientation     int
+	orientationType uint16 // SHORT (3) by default.
+	dateTime        string
+	original        string // DateTimeOriginal, in the Exif IFD.
+}
+
+// exifJPEG returns the start of a JPEG file with an Exif segment holding tags,
+// the segments before it and the start of the scan.
+func exifJPEG(order binary.ByteOrder, tags exifTags, before ...[]byte) []byte {
+	type entry struct {
+		tag, typ   uint16
+		count, val uint32
+	}
+	var ifd0, exifIFD []entry
+	var strs []string
+	// Strings are stored after the directories, their offsets are patched
+	// below.
+	str := func(s string) uint32 {
+		strs = append(strs, s)
+		return uint32(len(strs) - 1)
+	}
+	if tags.orientation != 0 {
+		typ := tags.orientationType
+		if typ == 0 {
+			typ = 3
+		}
+		val := uint32(tags.orientation)
+		if typ == 3 && order == binary.BigEndian {
+			// Values are left justified.
+			val <<= 16
+		}
+		ifd0 = append(ifd0, entry{exifOrientation, typ, 1, val})
+	}
+	if tags.dateTime != "" {
+		ifd0 = append(ifd0, entry{exifDateTime, 2, uint32(len(tags.dateTime) + 1), str(tags.dateTime)})
+	}
+	if tags.original != "" {
+		exifIFD = append(exifIFD, entry{exifDateTimeOriginal, 2, uint32(len(tags.original) + 1), str(tags.original)})
+		ifd0 = append(ifd0, entry{exifIFDPointer, 4, 1, 0})
+	}
+
+	size := func(es []entry) int { return 2 + 12*len(es) + 4 }
+	exifOff := 8 + size(ifd0)
+	strOff := exifOff + size(exifIFD)
+	offsets := []uint32{}
+	for _, s := range strs {
+		offsets = append(offsets, uint32(strOff))
+		strOff += len(s) + 1
+	}
+
+	var tiff bytes.Buffer
+	if order == binary.LittleEndian {
+		tiff.WriteString("II*\x00")
+	} else {
+		tiff.WriteString("MM\x00*")
+	}
+	binary.Write(&tiff, order, uint32(8))
+	for _, es := range [][]entry{ifd0, exifIFD} {
+		binary.Write(&tiff, order, uint16(len(es)))
+		for _, e := range es {
+			switch {
+			case e.tag == exifIFDPointer:
+				e.val = uint32(exifOff)
+			case e.typ == 2:
+				e.val = offsets[e.val]
+			}
+			binary.Write(&tiff, order, e)
+		}
+		binary.Write(&tiff, order, uint32(0))
+	}
+	for _, s := range strs {
+		tiff.WriteString(s + "\x00")
+	}
+
+	var b bytes.Buffer
+	b.WriteString("\xff\xd8")
+	for _, seg := range before {
+		b.Write(seg)
+	}
+	b.Write(jpegSegment(0xe1, append([]byte("Exif\x00\x00"), tiff.Bytes()...)))
+	b.Write(jpegSegment(0xda, []byte{0}))
+	return b.Bytes()
+}
+
+// jpegSegment returns a segment with the marker and data given.
+func jpegSegment(marker byte, data []byte) []byte {
+	b := []byte{0xff, marker, 0, 0}
+	binary.BigEndian.PutUint16(b[2:], uint16(len(data)+2))
+	return append(b, data...)
+}
+
+var byteOrders = []binary.ByteOrder{binary.LittleEndian, binary.BigEndian}
+
+func TestExifOrientation(t *testing.T) {
+	for _, order := range byteOrders {
+		for _, tt := range []struct {
+			name string
+			data []byte
+			want int
+		}{
+			{"normal", exifJPEG(order, exifTags{orientation: 1}), 1},
+			{"rotated", exifJPEG(order, exifTags{orientation: 6}), 6},
+			{"mirrored", exifJPEG(order, exifTags{orientation: 7, dateTime: "2001:02:03 04:05:06"}), 7},
+			{"after other segments", exifJPEG(order, exifTags{orientation: 8},
+				jpegSegment(0xe0, []byte("JFIF\x00\x01\x02")),
+				jpegSegment(0xe1, []byte("http://ns.adobe.com/xap/1.0/\x00<x/>"))), 8},
+			{"missing", exifJPEG(order, exifTags{dateTime: "2001:02:03 04:05:06"}), 1},
+			{"invalid", exifJPEG(order, exifTags{orientation: 9}), 1},
+			{"not a SHORT", exifJPEG(order, exifTags{orientation: 6, orientationType: 4}), 1},
+		} {
+			x := readExif(bytes.NewReader(tt.data))
+			if x == nil {
+				t.Errorf("%s %s: no Exif data found", order, tt.name)
+			} else if got := x.orientation(); got != tt.want {
+				t.Errorf("%s %s: orientation is %d, want %d", order, tt.name, got, tt.want)
+			}
+		}
+
+		x := readExif(bytes.NewReader(exifJPEG(order, exifTags{orientation: 6})))
+		x.setOrientation(1)
+		if got := x.orientation(); got != 1 {
+			t.Errorf("%s: orientation is %d after setting it to 1", order, got)
+		}
+		if !bytes.HasPrefix(x.seg, []byte("Exif\x00\x00")) || !bytes.Equal(x.seg[6:], x.tiff) {
+			t.Errorf("%s: the segment does not hold the TIFF structure", order)
+		}
+	}
+
+	full := exifJPEG(binary.LittleEndian, exifTags{orientation: 6})
+	for _, tt := range []struct {
+		name string
+		data []byte
+	}{
+		{"not a JPEG", []byte("\x89PNG\r\n\x1a\n")},
+		{"no Exif", []byte("\xff\xd8\xff\xe0\x00\x04ab\xff\xda\x00\x03\x00")},
+		{"truncated", full[:len(full)/2]},
+		{"bad byte order", bytes.Replace(full, []byte("II*"), []byte("XX*"), 1)},
+	} {
+		if x := readExif(bytes.NewReader(tt.data)); x != nil {
+			t.Errorf("%s: found Exif data", tt.name)
+		}
+		if got := readExif(bytes.NewReader(tt.data)).orientation(); got != 1 {
+			t.Errorf("%s: orientation is %d, want 1", tt.name, got)
+		}
+	}
+}
+
+func TestExifDateTime(t *testing.T) {
+	date := func(s string) time.Time {
+		t, _ := time.Parse("2006-01-02 15:04:05", s)
+		return t
+	}
+	for _, order := range byteOrders {
+		for _, tt := range []struct {
+			name string
+			tags exifTags
+			want time.Time // Zero if there is none.
+		}{
+			{"original", exifTags{original: "2019:12:31 23:59:58", dateTime: "2020:06:01 10:00:00"}, date("2019-12-31 23:59:58")},
+			{"only DateTime", exifTags{dateTime: "2020:06:01 10:00:00"}, date("2020-06-01 10:00:00")},
+			{"invalid original", exifTags{original: "2019:13:45 99:00:00", dateTime: "2020:06:01 10:00:00"}, date("2020-06-01 10:00:00")},
+			{"blank original", exifTags{original: "    :  :     :  :  ", dateTime: "2020:06:01 10:00:00"}, date("2020-06-01 10:00:00")},
+			{"short", exifTags{dateTime: "2020:06:01"}, time.Time{}},
+			{"none", exifTags{orientation: 1}, time.Time{}},
+		} {
+			x := readExif(bytes.NewReader(exifJPEG(order, tt.tags)))
+			got, ok := x.dateTime()
+			if ok != !tt.want.IsZero() || !got.Equal(tt.want) {
+				t.Errorf("%s %s: dateTime is %v, %v, want %v", order, tt.name, got, ok, tt.want)
+			}
+		}
+	}
+
+	if _, ok := readExif(bytes.NewReader([]byte("GIF89a"))).dateTime(); ok {
+		t.Errorf("found a date in a GIF file")
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// External commands run with "!" block the viewer until they exit, those run
+// with "&" (like those of "batch" and "each") run in the background. Either
+// way, their exit status and the end of their output are shown for a while at
+// the bottom of the window. Commands that run for longer than --timeout are
+// killed, and the "cancel" command kills the commands running in the
+// background.
+
+const (
+	msgDelay = 5 * time.Second // How long messages are shown.
+	msgLines = 4               // Lines of output shown in messages.
+)
+
+var errCancelled = errors.New("cancelled")
+
+// job is a command, or a set of commands, running in the background.
+type job struct {
+	files  []string // The images it runs on.
+	cancel context.CancelFunc
+}
+
+// jobDone is sent on Canvas.done when a job exits.
+type jobDone struct {
+	*job
+	msg []string // Reports how it went.
+}
+
+// message is a transient message shown over the image.
+type message struct {
+	lines []string
+	timer *time.Timer
+	tick  <-chan time.Time // timer.C while shown, nil otherwise.
+}
+
+// command returns the command to run argv, killed after --timeout and when
+// ctx or the returned cancel function is done.
+func command(ctx context.Context, argv []string) (*exec.Cmd, context.Context, context.CancelFunc) {
+	var cancel context.CancelFunc
+	if flagTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, flagTimeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	c := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	// Don't wait for whatever it started, and still holds its output, to
+	// exit once it is killed.
+	c.WaitDelay = time.Second
+	return c, ctx, cancel
+}
+
+// runErr returns why a command run with ctx was killed, if it was.
+func runErr(ctx context.Context, err error) error {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return fmt.Errorf("timed out after %s", flagTimeout)
+	case context.Canceled:
+		return errCancelled
+	}
+	return err
+}
+
+// runExternal runs the command argv until it exits or ctx is done, with its
+// output going to stderr.
+func runExternal(ctx context.Context, argv []string) ([]byte, error) {
+	errLg.Println(argv)
+	c, ctx, cancel := command(ctx, argv)
+	defer cancel()
+	out, err := c.CombinedOutput()
+	os.Stderr.Write(out)
+	return out, runErr(ctx, err)
+}
+
+// start runs f in the background as a job on files. The context it is given
+// is cancelled by the "cancel" command, and it returns the message shown once
+// it is done.
+func (c *Canvas) start(files []string, f func(ctx context.Context) []string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &job{files: files, cancel: cancel}
+	c.jobs = append(c.jobs, j)
+	go func() {
+		msg := f(ctx)
+		cancel()
+		c.done <- jobDone{j, msg}
+	}()
+}
+
+// startExternal runs the command argv on files in the background.
+func (c *Canvas) startExternal(argv []string, files []string) {
+	c.start(files, func(ctx context.Context) []string {
+		out, err := runExternal(ctx, argv)
+		if err != nil {
+			errLg.Printf("%s: %s", argv[0], err)
+		}
+		return result(argv, out, err)
+	})
+	c.message([]string{fmt.Sprintf("%s: started", argv[0])})
+}
+
+// external runs the "!" (in the foreground) and "&" (in the background)
+// commands on the current image.
+func (c *Canvas) external(cmd cmd) {
+	name := c.i.src.file()
+	if name == "" {
+		errLg.Printf("Can't run commands on '%s', it is not a file.", c.i.name)
+		return
+	}
+	argv := expandFile(cmd.Args(), name)
+	if cmd[0] == "&" {
+		c.startExternal(argv, []string{name})
+		return
+	}
+	out, err := runExternal(context.Background(), argv)
+	if err != nil {
+		errLg.Printf("%s: %s", argv[0], err)
+	}
+	c.resync([]string{name})
+	c.message(result(argv, out, err))
+}
+
+// finished reports the end of a job, and updates the image list as it may
+// have moved or changed the images it was run on.
+func (c *Canvas) finished(d jobDone) {
+	for i, j := range c.jobs {
+		if j == d.job {
+			c.jobs = append(c.jobs[:i], c.jobs[i+1:]...)
+			break
+		}
+	}
+	c.resync(d.files)
+	c.message(d.msg)
+}
+
+// cancelJobs kills the jobs still running, they are reported when they exit.
+func (c *Canvas) cancelJobs() {
+	if len(c.jobs) == 0 {
+		c.message([]string{"No commands running."})
+		return
+	}
+	for _, j := range c.jobs {
+		j.cancel()
+	}
+}
+
+// result returns the message reporting that argv exited, with the last lines
+// of its output.
+func result(argv []string, out []byte, err error) []string {
+	status := "done"
+	if err != nil {
+		status = err.Error()
+	}
+	lines := []string{fmt.Sprintf("%s: %s", argv[0], status)}
+	out = bytes.TrimSpace(out)
+	if len(out) == 0 {
+		return lines
+	}
+	outLines := strings.Split(string(out), "\n")
+	if n := len(outLines); n > msgLines {
+		outLines = outLines[n-msgLines:]
+	}
+	return append(lines, outLines...)
+}
+
+// message shows lines at the bottom of the window, for msgDelay.
+func (c *Canvas) message(lines []string) {
+	c.msg.lines = lines
+	if c.msg.tick != nil && !c.msg.timer.Stop() {
+		<-c.msg.timer.C
+	}
+	if c.msg.timer == nil {
+		c.msg.timer = time.NewTimer(msgDelay)
+	} else {
+		c.msg.timer.Reset(msgDelay)
+	}
+	c.msg.tick = c.msg.timer.C
+	c.origin = c.show(c.origin)
+}
+
+// messageTick hides the message once it has been shown for long enough.
+func (c *Canvas) messageTick() {
+	c.msg.tick = nil
+	c.msg.lines = nil
+	c.origin = c.show(c.origin)
+}
+
+// paintMessage draws the message at the bottom of the window, above the
+// command line if it is open.
+func (c *Canvas) paintMessage() {
+	if c.msg.lines == nil {
+		return
+	}
+	w := window.Geom.Width()
+	lines := make([]string, len(c.msg.lines))
+	for i, l := range c.msg.lines {
+		lines[i] = textFit(l, w)
+	}
+	box := textImage(lines, image.Point{})
+	y := window.Geom.Height() - box.Bounds().Dy()
+	if c.prompt.active {
+		y -= textSize(nil).Y + textFace.Height
+	}
+	c.overlay(box, image.Pt(0, y))
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"image"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// globs is a flag holding a list of shell patterns, one per use of the flag.
+type globs []string
+
+func (g *globs) String() string {
+	return strings.Join(*g, " ")
+}
+
+func (g *globs) Set(s string) error {
+	if _, err := filepath.Match(s, ""); err != nil {
+		return err
+	}
+	*g = append(*g, s)
+	return nil
+}
+
+// match reports whether any of the patterns matches the base name of path.
+func (g globs) match(path string) bool {
+	for _, p := range g {
+		if ok, _ := filepath.Match(p, filepath.Base(path)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// regexps is a flag holding a list of regular expressions, one per use of the
+// flag.
+type regexps []*regexp.Regexp
+
+func (r *regexps) String() string {
+	var ss []string
+	for _, re := range *r {
+		ss = append(ss, re.String())
+	}
+	return strings.Join(ss, " ")
+}
+
+func (r *regexps) Set(s string) error {
+	re, err := regexp.Compile(s)
+	if err != nil {
+		return err
+	}
+	*r = append(*r, re)
+	return nil
+}
+
+// match reports whether any of the expressions matches path.
+func (r regexps) match(path string) bool {
+	for _, re := range r {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// excluded reports whether path (a file or a directory) is filtered out by
+// the exclude flags.
+func excluded(path string) bool {
+	return flagExclude.match(path) || flagExcludeRe.match(path)
+}
+
+// included reports whether the file path passes the include flags, if any.
+func included(path string) bool {
+	if len(flagInclude) == 0 && len(flagIncludeRe) == 0 {
+		return true
+	}
+	return flagInclude.match(path) || flagIncludeRe.match(path)
+}
+
+// isImage reports whether the contents of the file path look like any of the
+// registered image formats. Only the header is read.
+func isImage(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	_, _, err = image.DecodeConfig(bufio.NewReader(f))
+	return err != image.ErrFormat
+}
+
+// findFiles expands the arguments into the list of images to show.
+// Directories are replaced by the images in them, archives by their members
+// and "-" by the image piped on stdin. It also returns the directories that
+// were scanned.
+func findFiles(args []string) (imgs []*Img, dirs []string) {
+	for _, f := range args {
+		if f == "-" {
+			src, err := readStdin()
+			if err != nil {
+				errLg.Printf("Can't read stdin: %s", err)
+				continue
+			}
+			imgs = append(imgs, newSourceImg(stdinName, src))
+			continue
+		}
+
+		fi, err := os.Stat(f)
+		if err != nil {
+			errLg.Printf("Can't access '%s': %s", f, err)
+		} else if fi.IsDir() {
+			fs, ds := dirImages(f, 0, []os.FileInfo{fi})
+			for _, name := range fs {
+				imgs = append(imgs, newImg(name))
+			}
+			dirs = append(dirs, ds...)
+		} else if isImage(f) {
+			imgs = append(imgs, newImg(f))
+		} else if ims, err := archiveImages(f); err == errNotArchive {
+			errLg.Printf("Skipping '%s', not a known image format.", f)
+		} else if err != nil {
+			errLg.Printf("Can't read archive '%s': %s", f, err)
+		} else {
+			imgs = append(imgs, ims...)
+		}
+	}
+	return
+}
+
+// findListed is findFiles for a name read from stdin, where "-" can't be
+// stdin again.
+func findListed(name string) []*Img {
+	if name == "-" {
+		errLg.Printf("Skipping '-', stdin is the list of images.")
+		return nil
+	}
+	imgs, _ := findFiles([]string{name})
+	return imgs
+}
+
+// dirImages returns the images in dir, and in its subdirectories when
+// recursing, along with the directories it went through. depth is how far
+// below the directory given as an argument dir is, and seen the directories
+// being walked, to avoid looping through symlinks.
+func dirImages(dir string, depth int, seen []os.FileInfo) (files, dirs []string) {
+	dirs = append(dirs, dir)
+	fs, err := ioutil.ReadDir(dir)
+	if err != nil {
+		errLg.Printf("Can't read '%s': %s", dir, err)
+	}
+	for _, f := range fs {
+		name := filepath.Join(dir, f.Name())
+		if excluded(name) {
+			continue
+		}
+
+		// ReadDir does not follow symlinks.
+		if f.Mode()&os.ModeSymlink != 0 {
+			if f, err = os.Stat(name); err != nil {
+				continue
+			}
+		}
+
+		if f.IsDir() {
+			if !flagRecursive || (flagDepth > 0 && depth >= flagDepth) {
+				continue
+			}
+			if walking(seen, f) {
+				lg("Skipping '%s', it loops back to a parent directory.", name)
+				continue
+			}
+			fs, ds := dirImages(name, depth+1, append(seen, f))
+			files, dirs = append(files, fs...), append(dirs, ds...)
+		} else if wanted(name) {
+			files = append(files, name)
+		}
+	}
+	return
+}
+
+// wanted reports whether the file name, found in a directory, passes the
+// filters and is an image.
+func wanted(name string) bool {
+	return !excluded(name) && included(name) && isImage(name)
+}
+
+// walking reports whether dir is one of the directories in seen.
+func walking(seen []os.FileInfo, dir os.FileInfo) bool {
+	for _, s := range seen {
+		if os.SameFile(s, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// nameScanner returns a scanner reading the names in r, separated by sep.
+// Empty names are skipped.
+func nameScanner(r io.Reader, sep byte) *bufio.Scanner {
+	sc := bufio.NewScanner(r)
+	sc.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		start := 0
+		for start < len(data) && data[start] == sep {
+			start++
+		}
+		if i := bytes.IndexByte(data[start:], sep); i >= 0 {
+			return start + i + 1, data[start : start+i], nil
+		}
+		if atEOF && start < len(data) {
+			return len(data), data[start:], nil
+		}
+		return start, nil, nil
+	})
+	return sc
+}
+
+// streamFiles expands the names read by sc like findFiles does, and sends the
+// images found on out. They are sent in batches, holding whatever was found
+// since the last one was taken, so that long lists don't keep the receiver
+// busy.
+func streamFiles(sc *bufio.Scanner, out chan<- []*Img) {
+	found := make(chan *Img)
+	go func() {
+		for sc.Scan() {
+			for _, im := range findListed(sc.Text()) {
+				found <- im
+			}
+		}
+		if err := sc.Err(); err != nil {
+			errLg.Printf("Reading image names: %s", err)
+		}
+		close(found)
+	}()
+
+	var batch []*Img
+	for found != nil || len(batch) > 0 {
+		var send chan<- []*Img
+		if len(batch) > 0 {
+			send = out
+		}
+		select {
+		case im, ok := <-found:
+			if !ok {
+				found = nil
+				break
+			}
+			batch = append(batch, im)
+		case send <- batch:
+			batch = nil
+		}
+	}
+	lg("Done reading image names.")
+}
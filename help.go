@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"image"
+
+	"github.com/BurntSushi/xgbutil/xgraphics"
+)
+
+const (
+	helpMargin = 20   // Space (in pixels) between the help and the window edges.
+	helpShade  = 0xc0 // Opacity of the help background, out of 0xff.
+)
+
+// helpLines describes every key and mouse binding.
+func helpLines() (lines []string) {
+	for _, keyb := range keybinds {
+		lines = append(lines, fmt.Sprintf("%-10s %s", keyb.key, keyb.desc))
+	}
+	return append(lines, fmt.Sprintf("%-10s %s", "mouse", "Left mouse button will pan the image."))
+}
+
+func (c *Canvas) toggleHelp() {
+	if c.help < 0 {
+		c.help = 0
+	} else {
+		c.help = -1
+	}
+	c.origin = c.show(c.origin)
+}
+
+// helpCmd handles cmd while the help is shown. Panning up and down scrolls
+// it instead of the image. It returns false if cmd should run as usual.
+func (c *Canvas) helpCmd(cmd cmd) bool {
+	if cmd[0] != "pan" || (cmd[1] != "up" && cmd[1] != "down") {
+		return false
+	}
+	if cmd[1] == "up" {
+		c.help--
+	} else {
+		c.help++
+	}
+	c.paintHelp()
+	return true
+}
+
+// paintHelp draws the help in the middle of the window, over a darkened copy
+// of what is below it.
+func (c *Canvas) paintHelp() {
+	if c.help < 0 {
+		return
+	}
+
+	lines := helpLines()
+	size := textSize(lines)
+	rows := (window.Geom.Height() - 2*helpMargin - 2*textPad) / textFace.Height
+	if rows < 1 {
+		return
+	}
+	if len(lines) > rows {
+		c.help = max(0, min(c.help, len(lines)-rows))
+		lines = lines[c.help : c.help+rows]
+		size.Y = rows*textFace.Height + 2*textPad
+	} else {
+		c.help = 0
+	}
+	size.X = min(size.X, window.Geom.Width()-2*helpMargin)
+
+	r := image.Rectangle{Max: size}.Add(image.Pt(
+		max(0, (window.Geom.Width()-size.X)/2), max(0, (window.Geom.Height()-size.Y)/2)))
+	box := c.under(r)
+	for i := 0; i < len(box.Pix); i += 4 {
+		box.Pix[i] = uint8(int(box.Pix[i]) * (0xff - helpShade) / 0xff)
+		box.Pix[i+1] = uint8(int(box.Pix[i+1]) * (0xff - helpShade) / 0xff)
+		box.Pix[i+2] = uint8(int(box.Pix[i+2]) * (0xff - helpShade) / 0xff)
+	}
+	drawText(box, lines)
+	c.overlay(box, r.Min)
+}
+
+// under returns a copy of what the last call to show painted in the
+// rectangle r of the window.
+func (c *Canvas) under(r image.Rectangle) *xgraphics.Image {
+	box := xgraphics.New(window.X, image.Rectangle{Max: r.Size()})
+	bg := windowColor().BGRA()
+	for i := 0; i < len(box.Pix); i += 4 {
+		box.Pix[i], box.Pix[i+1], box.Pix[i+2], box.Pix[i+3] = bg.B, bg.G, bg.R, bg.A
+	}
+
+	// The part of r covered by the image, in the coordinates of what was
+	// painted.
+	shown := c.shownArea.Sub(c.shownArea.Min).Add(c.shownAt).Intersect(r)
+	if shown.Empty() {
+		return box
+	}
+	src := shown.Sub(c.shownAt).Add(c.shownArea.Min)
+	at := shown.Min.Sub(r.Min)
+	if c.shown == nil {
+		c.i.vimage.read(box, at, src)
+		return box
+	}
+	for y := 0; y < src.Dy(); y++ {
+		i := box.PixOffset(at.X, at.Y+y)
+		j := c.shown.PixOffset(src.Min.X, src.Min.Y+y)
+		copy(box.Pix[i:i+4*src.Dx()], c.shown.Pix[j:j+4*src.Dx()])
+	}
+	return box
+}
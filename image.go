@@ -2,106 +2,165 @@ package main
 
 import (
 	"image"
-	"os"
+	"image/gif"
+	"sync/atomic"
 	"time"
-
-	"github.com/BurntSushi/xgbutil/xgraphics"
 )
 
 type Img struct {
-	name    string
+	name    string // Shown in the title, the file name for image files.
+	src     source
 	load    chan *vimage
-	loading bool // Maybe we should use a nil load chan instead?
+	loading bool // Guarded by sched.mu.
+	gen     int  // Times the image was freed, guarded by sched.mu.
 	vimage  *vimage
+	seq     int // Order in which the image was found.
+	page    int // Page shown, for files holding several images.
+	marked  bool
+}
+
+var imgSeq int64 // Images are found by several goroutines.
+
+// newImg returns a new, not yet loaded, image for the file name.
+func newImg(name string) *Img {
+	return newSourceImg(name, fileSource(name))
 }
 
-// vimage acts as an xgraphics.Image type with a name.
-// (The name is the basename of the image's corresponding file name.)
+// newSourceImg returns a new, not yet loaded, image read from src.
+func newSourceImg(name string, src source) *Img {
+	seq := int(atomic.AddInt64(&imgSeq, 1))
+	return &Img{name: name, src: src, load: make(chan *vimage, 1), seq: seq}
+}
+
+// vimage is the image data of an Img. The image is kept decoded and
+// converted (and drawn to X) a tile at a time, see tile.go.
 type vimage struct {
-	*xgraphics.Image
-	err error // Nil unless there is an error loading or decoding the image.
+	*tiled
+	err   error // Nil unless there is an error loading or decoding the image.
+	pages int   // Number of pages in the file, 0 or 1 for most images.
+	anim  *anim // Frames of an animation, tiled is the one shown.
+}
+
+// size returns the memory used by the image data.
+func (v *vimage) size() int {
+	if v.anim != nil {
+		n := 0
+		for _, f := range v.anim.frames {
+			n += f.bytes + f.tileBytes
+		}
+		return n
+	}
+	return v.bytes + v.tileBytes
+}
+
+// destroy frees the tiles and their pixmaps.
+func (v *vimage) destroy() {
+	if v.anim != nil {
+		for _, f := range v.anim.frames {
+			f.destroy()
+		}
+		return
+	}
+	v.tiled.destroy()
 }
 
-// newImage loads a decodes an image into an xgraphics.Image value and draws it
-// to an X pixmap.
-func newImage(img *Img) *vimage {
+// newImage loads and decodes an image, and converts the part of it that will
+// be shown first. It returns nil if loading was cancelled by the scheduler.
+// gen is the generation of img when it was claimed.
+func newImage(img *Img, gen int) *vimage {
 
 	start := time.Now()
-	file, err := os.Open(img.name)
+	file, err := img.src.open()
 	if err != nil {
 		errLg.Printf("Error opening '%s': %s", img.name, err)
-		return &vimage{nil, err}
+		return errorCard(img.name, err)
+	}
+	defer file.Close()
+
+	orient := 1
+	if !flagNoExif {
+		orient = readExif(file).orientation()
+		if _, err = file.Seek(0, 0); err != nil {
+			errLg.Printf("Error reading '%s': %s", img.name, err)
+			return errorCard(img.name, err)
+		}
 	}
 
-	im, kind, err := image.Decode(file)
+	var im image.Image
+	var g *gif.GIF // Set instead of im for animations.
+	var kind string
+	pages := 0
+	if order, ifds := tiffPages(file); len(ifds) > 1 {
+		pages, kind = len(ifds), "tiff"
+		if img.page >= pages {
+			img.page = 0
+		}
+		im, err = decodeTIFFPage(file, order, ifds, img.page)
+	} else if g, err = decodeGIF(file); g != nil {
+		kind = "gif"
+		if len(g.Image) == 1 {
+			im, g = g.Image[0], nil
+		}
+	} else if err == nil {
+		im, kind, err = image.Decode(file)
+	}
 	if err != nil {
 		errLg.Printf("Error decoding '%s': %s", img.name, err)
-		return &vimage{nil, err}
+		return errorCard(img.name, err)
 	}
 	lg("Decoded '%s' into image type '%s' (%s).", img.name, kind, time.Since(start))
 
-	// im = scale(im, window.Geom.Width(), window.Geom.Height())
-
-	start = time.Now()
-	reg := xgraphics.NewConvert(window.X, im)
-	lg("Converted '%s' to an xgraphics.Image type (%s).", img.name, time.Since(start))
-
-	// Only blend a checkered background if the image *may* have an alpha 
-	// channel. If we want to be a bit more efficient, we could type switch
-	// on all image types use Opaque, but this may add undesirable overhead.
-	// (Where the overhead is scanning the image for opaqueness.)
-	switch im.(type) {
-	case *image.Gray:
-	case *image.Gray16:
-	case *image.YCbCr:
-	default:
-		start = time.Now()
-		blendCheckered(reg)
-		lg("Blended '%s' into checkered background (%s).", img.name, time.Since(start))
+	// Conversion is the expensive part, don't bother if the user has moved
+	// far away from this image in the meantime.
+	if sched.cancel(img, gen) {
+		lg("Dropped '%s', it is no longer near the current image.", img.name)
+		return nil
 	}
 
-	if err = reg.CreatePixmap(); err != nil {
-		// TODO: We should display a "Could not load image" image instead
-		// of dying. However, creating a pixmap rarely fails, unless we have
-		// a *ton* of images. (In all likelihood, we'll run out of memory
-		// before a new pixmap cannot be created.)
-		errLg.Fatal(err)
+	var v *vimage
+	if g != nil {
+		v = &vimage{anim: newAnim(img.name, g)}
+		v.tiled = v.anim.frames[0]
+	} else {
+		v = &vimage{tiled: newTiled(im, orientations[orient], blends(im)), pages: pages}
 	}
 
-	reg.XDraw()
-
-	return &vimage{reg, err}
+	start = time.Now()
+	v.prefetch(image.Rectangle{Max: sched.viewport()})
+	lg("Converted the visible part of '%s' (%s).", img.name, time.Since(start))
+	return v
 }
 
-// blendCheckered is basically a copy of xgraphics.Blend with no interfaces.
-// (It's faster.) Also, it is hardcoded to blend into a checkered background.
-func blendCheckered(dest *xgraphics.Image) {
-	dsrc := dest.Bounds()
-	dmnx, dmxx, dmny, dmxy := dsrc.Min.X, dsrc.Max.X, dsrc.Min.Y, dsrc.Max.Y
-
-	clr1 := xgraphics.BGRA{B: 0xff, G: 0xff, R: 0xff, A: 0xff}
-	clr2 := xgraphics.BGRA{B: 0xde, G: 0xdc, R: 0xdf, A: 0xff}
-
-	var dx, dy int
-	var bgra, clr xgraphics.BGRA
-	for dx = dmnx; dx < dmxx; dx++ {
-		for dy = dmny; dy < dmxy; dy++ {
-			if dx%30 >= 15 {
-				if dy%30 >= 15 {
-					clr = clr1
-				} else {
-					clr = clr2
-				}
-			} else {
-				if dy%30 >= 15 {
-					clr = clr2
-				} else {
-					clr = clr1
-				}
+// blends reports whether im has to be blended into a checkered background,
+// that is if it has transparent parts. The standard image types know it, for
+// the others every pixel has to be looked at.
+func blends(im image.Image) bool {
+	if o, ok := im.(interface {
+		Opaque() bool
+	}); ok {
+		return !o.Opaque()
+	}
+	b := im.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if _, _, _, a := im.At(x, y).RGBA(); a != 0xffff {
+				return true
 			}
-
-			bgra = dest.At(dx, dy).(xgraphics.BGRA)
-			dest.SetBGRA(dx, dy, xgraphics.BlendBGRA(clr, bgra))
 		}
 	}
+	return false
+}
+
+// errorCard returns the image shown in place of name when it cannot be
+// loaded: the file name and the error, so the user can see what went wrong
+// and skip the file or act on it.
+func errorCard(name string, err error) *vimage {
+	card := textRGBA([]string{
+		"Could not load image",
+		"",
+		name,
+		"",
+		err.Error(),
+	}, image.Point{})
+	return &vimage{tiled: newTiled(card, nil, false), err: err}
 }
@@ -1,25 +1,59 @@
 package main
 
 import (
+	"bufio"
 	"flag"
 	"fmt"
 	"image"
 	_ "image/gif"
 	_ "image/jpeg"
 	_ "image/png"
-	"io/ioutil"
 	"os"
-	"path/filepath"
 	"runtime"
 	"runtime/pprof"
+	"strings"
+	"time"
 
 	"github.com/BurntSushi/xgbutil"
 	"github.com/BurntSushi/xgbutil/xevent"
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
 )
 
 var (
-	flagVerbose bool
-	flagProfile string
+	flagVerbose      bool
+	flagProfile      string
+	flagConfig       string
+	flagKeybindings  bool
+	flagIncrement    int
+	flagWidth        int
+	flagHeight       int
+	flagBackground   = rgb(0xffffff)
+	flagBgMode       string
+	flagCheckerSize  int
+	flagCheckerLight = rgb(0xffffff)
+	flagCheckerDark  = rgb(0xdfdcde)
+	flagSort         string
+	flagReverse      bool
+	flagRecursive    bool
+	flagDepth        int
+	flagStdin        bool
+	flagStdin0       bool
+	flagInclude      globs
+	flagExclude      globs
+	flagIncludeRe    regexps
+	flagExcludeRe    regexps
+	flagCacheSize    int
+	flagWriteBack    bool
+	flagNoExif       bool
+	flagNoWatch      bool
+	flagSocket       string
+	flagOutput       bool
+	flagJobs         int
+	flagTimeout      time.Duration
+	flagPrint0       bool
+	flagRemote       bool
 
 	window *Window
 )
@@ -29,8 +63,38 @@ func init() {
 
 	flag.BoolVar(&flagVerbose, "v", false, "Print logging output to stderr.")
 	flag.StringVar(&flagProfile, "profile", "", "Save CPU profile to the given file.")
+	flag.StringVar(&flagConfig, "config", "", "Read the configuration from this file (default "+configPath()+").")
+	flag.BoolVar(&flagKeybindings, "keybindings", false, "Print the key and mouse bindings and exit.")
+	flag.IntVar(&flagIncrement, "increment", 20, "Increment (in pixels) used to pan the image.")
+	flag.IntVar(&flagWidth, "width", 0, "Initial width of the window (default full screen).")
+	flag.IntVar(&flagHeight, "height", 0, "Initial height of the window (default full screen).")
+	flag.Var(&flagBackground, "background", "Color (#rrggbb) of the window around the image.")
+	flag.StringVar(&flagBgMode, "background-mode", "checker", "Background of transparent images: "+strings.Join(backgroundModes, ", ")+".")
+	flag.IntVar(&flagCheckerSize, "checker-size", 15, "Size (in pixels) of the squares behind transparent images.")
+	flag.Var(&flagCheckerLight, "checker-light", "Color (#rrggbb) of the light squares behind transparent images.")
+	flag.Var(&flagCheckerDark, "checker-dark", "Color (#rrggbb) of the dark squares behind transparent images.")
+	flag.StringVar(&flagSort, "sort", "none", "Sort images by "+sortOrders+".")
+	flag.BoolVar(&flagReverse, "reverse", false, "Reverse the sort order.")
+	flag.BoolVar(&flagRecursive, "r", false, "Look for images in subdirectories too.")
+	flag.BoolVar(&flagRecursive, "recursive", false, "Same as -r.")
+	flag.BoolVar(&flagStdin, "i", false, "Also show the images (or directories) named on stdin, one per line.")
+	flag.BoolVar(&flagStdin0, "0", false, "Same as -i, with names separated by NUL characters (as in find -print0).")
+	flag.IntVar(&flagDepth, "depth", 0, "How deep to go into subdirectories with -r (0 is no limit).")
+	flag.Var(&flagInclude, "include", "Only show files whose name matches this glob (may be repeated).")
+	flag.Var(&flagExclude, "exclude", "Skip files and directories whose name matches this glob (may be repeated).")
+	flag.Var(&flagIncludeRe, "include-re", "Only show files whose path matches this regexp (may be repeated).")
+	flag.Var(&flagExcludeRe, "exclude-re", "Skip files and directories whose path matches this regexp (may be repeated).")
+	flag.IntVar(&flagCacheSize, "cache", 512, "Memory (in MB) used to keep loaded images around.")
+	flag.BoolVar(&flagWriteBack, "write", false, "Save rotated and flipped images back to their files.")
+	flag.BoolVar(&flagNoExif, "noexif", false, "Do not rotate JPEGs according to their Exif orientation.")
+	flag.BoolVar(&flagNoWatch, "nowatch", false, "Do not watch files and directories for changes.")
+	flag.BoolVar(&flagOutput, "o", false, "On quit, print the names of the marked images to stdout, one per line.")
+	flag.BoolVar(&flagPrint0, "print0", false, "With -o, end names with a NUL character instead of a newline.")
+	flag.IntVar(&flagJobs, "jobs", runtime.NumCPU(), "Commands run at the same time by 'each'.")
+	flag.DurationVar(&flagTimeout, "timeout", 10*time.Minute, "Kill external commands running for longer than this (0 for no limit).")
+	flag.StringVar(&flagSocket, "socket", socketPath(), "Listen for commands on this Unix socket (empty to not listen).")
+	flag.BoolVar(&flagRemote, "remote", false, "Send the command given (or read from stdin) to the instance listening on --socket and exit.")
 	flag.Usage = usage
-	flag.Parse()
 }
 
 func usage() {
@@ -38,15 +102,40 @@ func usage() {
 	flag.PrintDefaults()
 
 	fmt.Print("\nControls:\n\n")
-	for _, keyb := range keybinds {
-		fmt.Printf("%-10s %s\n", keyb.key, keyb.desc)
+	for _, l := range helpLines() {
+		fmt.Println(l)
 	}
-	fmt.Printf("%-10s %s\n", "mouse", "Left mouse button will pan the image.\n")
+	fmt.Println()
 
 	os.Exit(2)
 }
 
 func main() {
+	flag.Parse()
+
+	if flagConfig != "" {
+		loadConfig(flagConfig, false)
+	} else {
+		loadConfig(configPath(), true)
+	}
+
+	if err := setBackgroundMode(flagBgMode); err != nil {
+		errLg.Fatal(err)
+	}
+
+	if flagKeybindings {
+		for _, l := range helpLines() {
+			fmt.Println(l)
+		}
+		return
+	}
+
+	if flagRemote {
+		if err := remoteClient(flagSocket, flag.Args()); err != nil {
+			errLg.Fatal(err)
+		}
+		return
+	}
 
 	if flagProfile != "" {
 		f, err := os.Create(flagProfile)
@@ -57,7 +146,7 @@ func main() {
 		defer pprof.StopCPUProfile()
 	}
 
-	if flag.NArg() == 0 {
+	if flag.NArg() == 0 && !flagStdin && !flagStdin0 {
 		errLg.Print("No images specified.\n\n")
 		usage()
 	}
@@ -68,22 +157,71 @@ func main() {
 		errLg.Fatal(err)
 	}
 
-	files := findFiles(flag.Args())
+	for _, arg := range flag.Args() {
+		if arg == "-" && (flagStdin || flagStdin0) {
+			errLg.Fatal("Can't read both an image and image names from stdin.")
+		}
+	}
+	imgs, dirs := findFiles(flag.Args())
+
+	// Only wait for the first image named on stdin, the rest are added
+	// while it is shown.
+	var stdin *bufio.Scanner
+	if flagStdin || flagStdin0 {
+		sep := byte('\n')
+		if flagStdin0 {
+			sep = 0
+		}
+		stdin = nameScanner(os.Stdin, sep)
+		for len(imgs) == 0 && stdin.Scan() {
+			imgs = findListed(stdin.Text())
+		}
+	}
 
-	if len(files) == 0 {
+	if len(imgs) == 0 {
 		errLg.Fatal("No images specified could be shown.")
 	}
 
-	canvas := Canvas{imgs: make([]*Img, 0, len(files))}
-	for _, name := range files {
-		canvas.imgs = append(canvas.imgs, &Img{name, make(chan *vimage, 1), false, nil})
+	canvas := Canvas{
+		imgs:    imgs,
+		order:   flagSort,
+		reverse: flagReverse,
+		keys:    map[*Img]interface{}{},
+		zoom:    1,
+		anim:    player{loops: -1},
+		help:    -1,
+		done:    make(chan jobDone),
+	}
+	if err := sortImages(canvas.imgs, flagSort, flagReverse, canvas.keys); err != nil {
+		errLg.Fatal(err)
 	}
 
 	chans := chans{
 		ctl: make(chan cmd, 0),
+		key: make(chan string, 0),
 
 		panStartChan: make(chan image.Point, 0),
 		panStepChan:  make(chan image.Point, 0),
+
+		fs: make(chan fsEvent, 0),
+
+		remote: make(chan remoteReq, 0),
+
+		files: make(chan []*Img, 0),
+	}
+
+	if stdin != nil {
+		go streamFiles(stdin, chans.files)
+	}
+
+	if !flagNoWatch {
+		var watched []string
+		for _, im := range canvas.imgs {
+			if f := im.src.file(); f != "" {
+				watched = append(watched, f)
+			}
+		}
+		go watch(watched, dirs, chans.fs)
 	}
 
 	// Create the X window before starting anything so that the user knows
@@ -92,38 +230,16 @@ func main() {
 	window.setName("VImg")
 	window.setupEventHandlers(chans)
 
+	if flagSocket != "" {
+		if err := listenRemote(flagSocket, chans.remote); err != nil {
+			errLg.Print(err)
+		}
+		defer stopRemote()
+	}
+
 	// Create the canvas, this is the heart of the app
 	go canvas.run(chans)
 
 	// Start the main X event loop.
 	xevent.Main(X)
 }
-
-func findFiles(args []string) (files []string) {
-	for _, f := range args {
-		fi, err := os.Stat(f)
-		if err != nil {
-			errLg.Print("Can't access", f, err)
-		} else if fi.IsDir() {
-			files = append(files, dirImages(f)...)
-		} else {
-			files = append(files, f)
-		}
-	}
-	return
-}
-
-func dirImages(dir string) (files []string) {
-	fs, _ := ioutil.ReadDir(dir)
-	for _, f := range fs {
-		if f.IsDir() {
-			// For now ignore directories
-			// Maybe we should add a recursive flag?
-
-			// TODO filter by regexp
-		} else if filepath.Ext(f.Name()) != "" {
-			files = append(files, filepath.Join(dir, f.Name()))
-		}
-	}
-	return
-}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"image"
+	"os"
+)
+
+// Images can be marked while going through them, e.g. to pick the ones to
+// keep. With -o, the names of the marked images are printed to stdout on
+// quit, so vimg can be used in a pipeline.
+
+// markCmd runs the "mark" command: toggle (the default) marks or unmarks the
+// current image, all and none mark or unmark every image and invert toggles
+// them all.
+func (c *Canvas) markCmd(args []string) {
+	how := "toggle"
+	if len(args) > 0 {
+		how = args[0]
+	}
+
+	switch how {
+	case "toggle":
+		c.i.marked = !c.i.marked
+	case "all", "none":
+		for _, im := range c.imgs {
+			im.marked = how == "all"
+		}
+	case "invert":
+		for _, im := range c.imgs {
+			im.marked = !im.marked
+		}
+	default:
+		errLg.Printf("Invalid mark command: %v", args)
+		return
+	}
+	c.origin = c.show(c.origin)
+}
+
+// marks returns the number of marked images.
+func (c *Canvas) marks() int {
+	n := 0
+	for _, im := range c.imgs {
+		if im.marked {
+			n++
+		}
+	}
+	return n
+}
+
+// paintMark draws the mark of the current image, if it is marked, in the top
+// right corner of the window.
+func (c *Canvas) paintMark() {
+	if !c.i.marked {
+		return
+	}
+	badge := textImage([]string{"Marked"}, image.Point{})
+	c.overlay(badge, image.Pt(window.Geom.Width()-badge.Bounds().Dx(), 0))
+}
+
+// printMarks prints the file names of the marked images with -o, in the order
+// they are shown, each followed by a newline or, with --print0, a NUL
+// character. Images that are not files are skipped.
+func (c *Canvas) printMarks() {
+	if !flagOutput {
+		return
+	}
+	sep := byte('\n')
+	if flagPrint0 {
+		sep = 0
+	}
+	w := bufio.NewWriter(os.Stdout)
+	for _, im := range c.imgs {
+		if !im.marked {
+			continue
+		}
+		if f := im.src.file(); f != "" {
+			w.WriteString(f)
+			w.WriteByte(sep)
+		} else {
+			errLg.Printf("Not printing '%s', it is not a file.", im.name)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		errLg.Printf("Could not print the marked images: %s", err)
+	}
+}
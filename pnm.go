@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+)
+
+// A decoder for the Netpbm formats: PBM (P1, P4), PGM (P2, P5) and PPM (P3,
+// P6), in both their plain (ASCII) and raw variants.
+
+func init() {
+	for _, magic := range []string{"P1", "P2", "P3", "P4", "P5", "P6"} {
+		image.RegisterFormat("pnm", magic, decodePNM, decodePNMConfig)
+	}
+}
+
+var errPNM = errors.New("pnm: invalid format")
+
+// maxPNMBytes bounds the memory taken by a decoded image, so that a corrupt
+// header can't make the decoder allocate more than the machine has.
+const maxPNMBytes = 1 << 30
+
+// pnmHeader is the header of a Netpbm file, max is 1 for bitmaps.
+type pnmHeader struct {
+	kind byte // '1' to '6'.
+	w, h int
+	max  int
+}
+
+// plain reports whether the raster is written in ASCII.
+func (h pnmHeader) plain() bool { return h.kind <= '3' }
+
+// bytes returns the size of the pixels of the decoded image.
+func (h pnmHeader) bytes() int64 {
+	n := int64(h.w) * int64(h.h)
+	if h.kind == '3' || h.kind == '6' {
+		n *= 4 // RGBA
+	}
+	if h.max > 0xff {
+		n *= 2
+	}
+	return n
+}
+
+// readPNMHeader reads the header up to and including the single white space
+// character that precedes the raster.
+func readPNMHeader(r *bufio.Reader) (h pnmHeader, err error) {
+	var magic [2]byte
+	if _, err = io.ReadFull(r, magic[:]); err != nil {
+		return
+	}
+	if magic[0] != 'P' || magic[1] < '1' || magic[1] > '6' {
+		return h, errPNM
+	}
+	h.kind, h.max = magic[1], 1
+
+	fields := []*int{&h.w, &h.h}
+	if h.kind != '1' && h.kind != '4' {
+		fields = append(fields, &h.max)
+	}
+	for _, f := range fields {
+		if *f, err = pnmInt(r); err != nil {
+			return
+		}
+	}
+	if h.w <= 0 || h.h <= 0 || h.max <= 0 || h.max > 0xffff || h.bytes() > maxPNMBytes {
+		return h, errPNM
+	}
+	// The last number is followed by exactly one white space character.
+	c, err := r.ReadByte()
+	if err == nil && !pnmSpace(c) {
+		err = errPNM
+	}
+	return
+}
+
+func pnmSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
+
+// pnmSkip skips white space and comments, and returns the next character.
+func pnmSkip(r *bufio.Reader) (byte, error) {
+	c, err := r.ReadByte()
+	for err == nil && (pnmSpace(c) || c == '#') {
+		if c == '#' {
+			for err == nil && c != '\n' && c != '\r' {
+				c, err = r.ReadByte()
+			}
+		}
+		if err == nil {
+			c, err = r.ReadByte()
+		}
+	}
+	return c, err
+}
+
+// pnmInt reads a decimal number, skipping white space and comments before it.
+// The character after the number is left unread.
+func pnmInt(r *bufio.Reader) (int, error) {
+	c, err := pnmSkip(r)
+	if err != nil {
+		return 0, err
+	}
+	if c < '0' || c > '9' {
+		return 0, errPNM
+	}
+
+	n := 0
+	for ; err == nil && c >= '0' && c <= '9'; c, err = r.ReadByte() {
+		if n = n*10 + int(c-'0'); n > 1<<30 {
+			return 0, errPNM
+		}
+	}
+	if err == nil {
+		err = r.UnreadByte()
+	} else if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func decodePNMConfig(r io.Reader) (image.Config, error) {
+	h, err := readPNMHeader(bufio.NewReader(r))
+	if err != nil {
+		return image.Config{}, err
+	}
+	var m color.Model
+	switch {
+	case h.kind == '3' || h.kind == '6':
+		m = color.RGBAModel
+		if h.max > 0xff {
+			m = color.RGBA64Model
+		}
+	case h.max > 0xff:
+		m = color.Gray16Model
+	default:
+		m = color.GrayModel
+	}
+	return image.Config{ColorModel: m, Width: h.w, Height: h.h}, nil
+}
+
+func decodePNM(r io.Reader) (image.Image, error) {
+	br := bufio.NewReader(r)
+	h, err := readPNMHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	if h.kind == '4' {
+		return decodePBM(br, h)
+	}
+
+	channels := 1
+	if h.kind == '3' || h.kind == '6' {
+		channels = 3
+	}
+	wide := h.max > 0xff
+
+	// Every sample is read into the 8 or 16 bit row of the output image,
+	// scaled from 0..max to the full range.
+	var rect = image.Rect(0, 0, h.w, h.h)
+	var pix []uint8
+	var stride int
+	var im image.Image
+	switch {
+	case channels == 3 && wide:
+		m := image.NewRGBA64(rect)
+		im, pix, stride = m, m.Pix, m.Stride
+	case channels == 3:
+		m := image.NewRGBA(rect)
+		im, pix, stride = m, m.Pix, m.Stride
+	case wide:
+		m := image.NewGray16(rect)
+		im, pix, stride = m, m.Pix, m.Stride
+	default:
+		m := image.NewGray(rect)
+		im, pix, stride = m, m.Pix, m.Stride
+	}
+
+	sample := func() (int, error) {
+		switch {
+		case h.kind == '1':
+			// Plain bitmap pixels need not be separated.
+			c, err := pnmSkip(br)
+			if err == nil && c != '0' && c != '1' {
+				err = errPNM
+			}
+			return int(c - '0'), err
+		case h.plain():
+			return pnmInt(br)
+		}
+		c, err := br.ReadByte()
+		if err != nil || h.max <= 0xff {
+			return int(c), err
+		}
+		c2, err := br.ReadByte()
+		return int(c)<<8 | int(c2), err
+	}
+
+	for y := 0; y < h.h; y++ {
+		row := pix[y*stride:]
+		for x := 0; x < h.w; x++ {
+			for ch := 0; ch < channels; ch++ {
+				v, err := sample()
+				if err != nil {
+					return nil, fmt.Errorf("pnm: reading pixel data: %s", err)
+				}
+				if v > h.max {
+					v = h.max
+				}
+				if h.kind == '1' {
+					// In bitmaps 1 is black.
+					v = 1 - v
+				}
+
+				i := x*channels + ch
+				if channels == 3 {
+					i = x*4 + ch
+				}
+				if wide {
+					v = v * 0xffff / h.max
+					row[2*i], row[2*i+1] = uint8(v>>8), uint8(v)
+				} else {
+					row[i] = uint8(v * 0xff / h.max)
+				}
+			}
+			if channels == 3 {
+				// Opaque alpha.
+				if wide {
+					row[8*x+6], row[8*x+7] = 0xff, 0xff
+				} else {
+					row[4*x+3] = 0xff
+				}
+			}
+		}
+	}
+	return im, nil
+}
+
+// decodePBM decodes a raw bitmap, rows are packed eight pixels to a byte with
+// the most significant bit first and 1 meaning black.
+func decodePBM(r *bufio.Reader, h pnmHeader) (image.Image, error) {
+	m := image.NewGray(image.Rect(0, 0, h.w, h.h))
+	row := make([]byte, (h.w+7)/8)
+	for y := 0; y < h.h; y++ {
+		if _, err := io.ReadFull(r, row); err != nil {
+			return nil, fmt.Errorf("pnm: reading pixel data: %s", err)
+		}
+		pix := m.Pix[y*m.Stride:]
+		for x := 0; x < h.w; x++ {
+			if row[x/8]&(0x80>>uint(x%8)) == 0 {
+				pix[x] = 0xff
+			}
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func gray(w, h int, pix ...uint8) *image.Gray {
+	return &image.Gray{Pix: pix, Stride: w, Rect: image.Rect(0, 0, w, h)}
+}
+
+func gray16(w, h int, pix ...uint16) *image.Gray16 {
+	m := image.NewGray16(image.Rect(0, 0, w, h))
+	for i, v := range pix {
+		m.Pix[2*i], m.Pix[2*i+1] = uint8(v>>8), uint8(v)
+	}
+	return m
+}
+
+func rgba(w, h int, pix ...uint8) *image.RGBA {
+	return &image.RGBA{Pix: pix, Stride: 4 * w, Rect: image.Rect(0, 0, w, h)}
+}
+
+func TestDecodePNM(t *testing.T) {
+	for _, tt := range []struct {
+		name, data string
+		want       image.Image // Nil if decoding fails.
+	}{
+		{"P1", "P1\n3 2\n0 1 0\n1 0 1\n", gray(3, 2, 0xff, 0, 0xff, 0, 0xff, 0)},
+		{"P1 packed", "P1 3 2 010101", gray(3, 2, 0xff, 0, 0xff, 0, 0xff, 0)},
+		{"P1 comments", "P1# width\n3 # height\n2\n0 1 0 # first row\n1 0 1", gray(3, 2, 0xff, 0, 0xff, 0, 0xff, 0)},
+		{"P2", "P2\n2 2\n15\n0 5\n10 15\n", gray(2, 2, 0, 85, 170, 255)},
+		{"P2 above max", "P2 1 1 15 16", gray(1, 1, 255)},
+		{"P2 16 bit", "P2\n2 1\n1000\n0 500\n", gray16(2, 1, 0, 32767)},
+		{"P3", "P3\n2 1\n255\n255 0 0 0 128 255\n", rgba(2, 1, 255, 0, 0, 255, 0, 128, 255, 255)},
+		{"P4", "P4\n3 2\n\x40\xa0", gray(3, 2, 0xff, 0, 0xff, 0, 0xff, 0)},
+		{"P4 row padding", "P4 9 1\n\x80\x80", gray(9, 1, 0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0)},
+		{"P5", "P5\n2 2\n255\n\x00\x40\x80\xff", gray(2, 2, 0, 0x40, 0x80, 0xff)},
+		{"P5 comment", "P5\n# made by hand\n2 1\n255\n\x0a\x0d", gray(2, 1, 0x0a, 0x0d)},
+		{"P5 16 bit", "P5\n2 1\n65535\n\x12\x34\xff\xff", gray16(2, 1, 0x1234, 0xffff)},
+		{"P5 12 bit", "P5 1 1 4095\n\x0f\xff", gray16(1, 1, 0xffff)},
+		{"P6", "P6\n1 2\n255\n\x01\x02\x03\xfd\xfe\xff", rgba(1, 2, 1, 2, 3, 255, 0xfd, 0xfe, 0xff, 255)},
+
+		{"no magic", "P7\n1 1\n255\n\x00", nil},
+		{"zero width", "P5\n0 1\n255\n", nil},
+		{"zero max", "P5\n1 1\n0\n\x00", nil},
+		{"max too large", "P5\n1 1\n65536\n\x00\x00", nil},
+		{"too large", "P5 1000000000 1000000000 255\n\x00\x00", nil},
+		{"too large 16 bit", "P6 16384 16384 65535\n\x00\x00", nil},
+		{"too large bitmap", "P4 1073741824 2\n\x00\x00", nil},
+		{"no space after max", "P5\n1 1\n255x\x00", nil},
+		{"truncated header", "P6\n3 ", nil},
+		{"truncated P1", "P1\n3 2\n0 1 0\n1", nil},
+		{"truncated P3", "P3\n1 1\n255\n1 2", nil},
+		{"truncated P4", "P4\n3 2\n\x40", nil},
+		{"truncated P5", "P5\n2 2\n255\n\x00\x01\x02", nil},
+		{"truncated P6 16 bit", "P6\n1 1\n65535\n\x00\x01\x02\x03\x04", nil},
+		{"invalid P1", "P1\n1 1\n2", nil},
+		{"invalid P2", "P2\n1 1\n255\nx", nil},
+	} {
+		im, err := decodePNM(bytes.NewReader([]byte(tt.data)))
+		switch {
+		case tt.want == nil && err == nil:
+			t.Errorf("%s: decoded %v, want an error", tt.name, im)
+		case tt.want == nil:
+		case err != nil:
+			t.Errorf("%s: %s", tt.name, err)
+		case fmt.Sprintf("%T", im) != fmt.Sprintf("%T", tt.want):
+			t.Errorf("%s: decoded a %T, want a %T", tt.name, im, tt.want)
+		case !im.Bounds().Eq(tt.want.Bounds()):
+			t.Errorf("%s: bounds are %v, want %v", tt.name, im.Bounds(), tt.want.Bounds())
+		default:
+			b := im.Bounds()
+			for y := b.Min.Y; y < b.Max.Y; y++ {
+				for x := b.Min.X; x < b.Max.X; x++ {
+					if got, want := im.At(x, y), tt.want.At(x, y); got != want {
+						t.Errorf("%s: pixel (%d, %d) is %v, want %v", tt.name, x, y, got, want)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestDecodePNMConfig(t *testing.T) {
+	for _, tt := range []struct {
+		data string
+		want image.Config
+	}{
+		{"P1 4 3\n", image.Config{ColorModel: color.GrayModel, Width: 4, Height: 3}},
+		{"P4\n# comment\n4 3\n", image.Config{ColorModel: color.GrayModel, Width: 4, Height: 3}},
+		{"P2 4 3 255\n", image.Config{ColorModel: color.GrayModel, Width: 4, Height: 3}},
+		{"P5 4 3 256\n", image.Config{ColorModel: color.Gray16Model, Width: 4, Height: 3}},
+		{"P3 4 3 255\n", image.Config{ColorModel: color.RGBAModel, Width: 4, Height: 3}},
+		{"P6 4 3 65535\n", image.Config{ColorModel: color.RGBA64Model, Width: 4, Height: 3}},
+	} {
+		got, err := decodePNMConfig(bytes.NewReader([]byte(tt.data)))
+		if err != nil {
+			t.Errorf("%q: %s", tt.data, err)
+		} else if got != tt.want {
+			t.Errorf("%q: got %+v, want %+v", tt.data, got, tt.want)
+		}
+	}
+
+	if _, err := decodePNMConfig(bytes.NewReader([]byte("P5 1000000000 1000000000 255\n"))); err != errPNM {
+		t.Errorf("huge image: got %v, want %v", err, errPNM)
+	}
+
+	if _, kind, err := image.DecodeConfig(bytes.NewReader([]byte("P6 1 1 255\n"))); kind != "pnm" || err != nil {
+		t.Errorf("image.DecodeConfig: got %q, %v, want pnm", kind, err)
+	}
+}
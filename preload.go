@@ -0,0 +1,170 @@
+package main
+
+import (
+	"image"
+	"runtime"
+	"sync"
+)
+
+// PreloadQueueSize is the number of images around the current one (half of
+// them in each direction) that are preloaded.
+const PreloadQueueSize = 32
+
+// scheduler hands images to the preloaders in order of distance from the
+// current image. The queue is rebuilt on every call to update, so jumping to
+// any image immediately moves it and its neighbours to the front, and work
+// on images that are now far away is dropped.
+type scheduler struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queue  []*Img       // Images waiting to be loaded, nearest first.
+	wanted map[*Img]int // Distance from the current image of every image in the window.
+	last   int          // Index of the previous current image.
+	view   image.Point  // Size of the window, see viewport.
+
+	sizes  map[*Img]int // Memory used by every loaded image, see cache.go.
+	size   int          // Sum of sizes.
+	budget int          // Maximum size before images are evicted.
+}
+
+var sched *scheduler
+
+// preload reprioritizes the preloaders around the image at idx, starting them
+// the first time it is called.
+func preload(imgs []*Img, idx int) {
+	if sched == nil {
+		sched = &scheduler{
+			wanted: map[*Img]int{},
+			sizes:  map[*Img]int{},
+			budget: flagCacheSize << 20,
+		}
+		sched.cond = sync.NewCond(&sched.mu)
+		for i := 0; i < runtime.NumCPU(); i++ {
+			go sched.loader()
+		}
+	}
+	sched.update(imgs, idx)
+}
+
+// load returns the image data of im, decoding it if nobody has done it yet,
+// or waiting for the preloader that is already working on it.
+func load(im *Img) *vimage {
+	if im.vimage != nil {
+		return im.vimage
+	}
+	gen, ok := sched.claim(im)
+	if !ok {
+		vimg := <-im.load
+		im.load <- vimg
+		return vimg
+	}
+
+	vimg := newImage(im, gen)
+	sched.done(im, vimg, gen)
+	return vimg
+}
+
+func (s *scheduler) loader() {
+	for {
+		im, gen := s.next()
+		if vimg := newImage(im, gen); vimg != nil {
+			s.done(im, vimg, gen)
+		}
+		runtime.Gosched()
+	}
+}
+
+// update rebuilds the queue around idx. Images are visited walking outwards
+// in both directions (wrapping around the ends of the list), favouring the
+// direction in which the user moved last. Since it is called from the canvas
+// goroutine, it is also where images are evicted from the cache.
+func (s *scheduler) update(imgs []*Img, idx int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := len(imgs)
+	dir := 1
+	if (idx-s.last+n)%n > n/2 {
+		dir = -1
+	}
+	s.last = idx
+	s.view = image.Pt(window.Geom.Width(), window.Geom.Height())
+
+	s.queue = s.queue[:0]
+	s.wanted = map[*Img]int{}
+	for d := 0; d <= PreloadQueueSize/2; d++ {
+		for _, i := range []int{idx + d*dir, idx - d*dir} {
+			im := imgs[(i%n+n)%n]
+			if _, ok := s.wanted[im]; ok {
+				continue
+			}
+			s.wanted[im] = d
+			if im.vimage == nil && !im.loading {
+				s.queue = append(s.queue, im)
+			}
+		}
+	}
+	s.evict(imgs, idx)
+	s.cond.Broadcast()
+}
+
+// next blocks until there is an image in the queue and the cache has room for
+// it, and claims the nearest one. It also returns the generation of the image
+// at the time, see done.
+func (s *scheduler) next() (*Img, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for len(s.queue) == 0 || s.size >= s.budget {
+		s.cond.Wait()
+	}
+	im := s.queue[0]
+	s.queue = s.queue[1:]
+	im.loading = true
+	return im, im.gen
+}
+
+// claim marks im as being loaded by the caller, and returns its generation.
+// It returns false if somebody else already claimed it.
+func (s *scheduler) claim(im *Img) (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if im.loading {
+		return 0, false
+	}
+	im.loading = true
+	for i := range s.queue {
+		if s.queue[i] == im {
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			break
+		}
+	}
+	return im.gen, true
+}
+
+// cancel gives up on loading im if it has gone out of the preload window
+// since it was claimed with gen. It returns true if the caller should stop
+// working. If im was freed since, it may have been claimed again, and the new
+// claim is left alone.
+func (s *scheduler) cancel(im *Img, gen int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.wanted[im]; ok {
+		return false
+	}
+	if im.gen == gen {
+		im.loading = false
+	}
+	return true
+}
+
+// viewport returns the size of the window, as of the last call to update. It
+// is the part of images that loaders convert in advance.
+func (s *scheduler) viewport() image.Point {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.view
+}
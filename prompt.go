@@ -0,0 +1,148 @@
+package main
+
+import (
+	"image"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// prompt is the vim-like command line opened with ':'. While it is open, the
+// window sends key presses on chans.key instead of matching them against the
+// key bindings. Submitted lines are parsed with parseCmd.
+type prompt struct {
+	active  bool
+	line    string
+	history []string
+	hist    int      // Position in history while browsing it.
+	matches []string // Completions to show after an ambiguous Tab.
+}
+
+// promptEnd lists the keys that close the command line. The window needs to
+// know them too, to stop sending key presses to the canvas.
+var promptEnd = map[string]bool{
+	"Return":    true,
+	"KP_Enter":  true,
+	"Escape":    true,
+	"control-c": true,
+}
+
+func (c *Canvas) openPrompt() {
+	c.prompt.active = true
+	c.prompt.line = ""
+	c.prompt.hist = len(c.prompt.history)
+	c.prompt.matches = nil
+	c.paintPrompt()
+}
+
+func (c *Canvas) closePrompt() {
+	c.prompt.active = false
+	c.origin = c.show(c.origin)
+}
+
+// promptKey edits the command line according to key. It returns the command
+// to run when the line is submitted.
+func (c *Canvas) promptKey(key string) cmd {
+	p := &c.prompt
+	if !p.active {
+		return nil
+	}
+	p.matches = nil
+
+	switch key {
+	case "Return", "KP_Enter":
+		line := strings.TrimSpace(p.line)
+		c.closePrompt()
+		if line == "" {
+			return nil
+		}
+		if n := len(p.history); n == 0 || p.history[n-1] != line {
+			p.history = append(p.history, line)
+		}
+		cmd, err := parseCmd(line)
+		if err != nil {
+			errLg.Printf("Invalid command '%s': %s", line, err)
+			return nil
+		}
+		return cmd
+	case "Escape", "control-c":
+		c.closePrompt()
+		return nil
+	case "BackSpace":
+		if _, n := utf8.DecodeLastRuneInString(p.line); n > 0 {
+			p.line = p.line[:len(p.line)-n]
+		}
+	case "control-u":
+		p.line = ""
+	case "control-w":
+		p.line = strings.TrimRight(p.line, " ")
+		p.line = p.line[:strings.LastIndex(p.line, " ")+1]
+	case "Up":
+		if p.hist > 0 {
+			p.hist--
+			p.line = p.history[p.hist]
+		}
+	case "Down":
+		if p.hist < len(p.history)-1 {
+			p.hist++
+			p.line = p.history[p.hist]
+		} else {
+			p.hist = len(p.history)
+			p.line = ""
+		}
+	case "Tab":
+		p.complete()
+	default:
+		if utf8.RuneCountInString(key) == 1 {
+			p.line += key
+		}
+	}
+	c.paintPrompt()
+	return nil
+}
+
+// complete completes the command name being typed. If there are several
+// candidates, it completes their common prefix and lists them.
+func (p *prompt) complete() {
+	if strings.Contains(p.line, " ") {
+		return
+	}
+
+	var ms []string
+	for name := range commands {
+		if strings.HasPrefix(name, p.line) {
+			ms = append(ms, name)
+		}
+	}
+	sort.Strings(ms)
+
+	switch len(ms) {
+	case 0:
+	case 1:
+		p.line = ms[0] + " "
+	default:
+		pre := ms[0]
+		for _, m := range ms[1:] {
+			for !strings.HasPrefix(m, pre) {
+				pre = pre[:len(pre)-1]
+			}
+		}
+		p.line = pre
+		p.matches = ms
+	}
+}
+
+// paintPrompt draws the command line at the bottom of the window.
+func (c *Canvas) paintPrompt() {
+	if !c.prompt.active {
+		return
+	}
+
+	w := window.Geom.Width()
+	text := textFit(":"+c.prompt.line+"_", w)
+	if len(c.prompt.matches) > 0 {
+		text += "   " + strings.Join(c.prompt.matches, " ")
+	}
+	bar := textImage([]string{text}, image.Pt(w, textSize(nil).Y+textFace.Height))
+	c.overlay(bar, image.Pt(0, window.Geom.Height()-bar.Bounds().Dy()))
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Other programs drive the viewer through a Unix domain socket. Every line
+// written to it is a command, in the syntax of the command line (see
+// parseCmd), run by the canvas goroutine like a key binding would. Every
+// command is answered with a line holding the status of the viewer as JSON.
+// An empty line, or "status", only asks for the status.
+
+// status is the reply to a remote command.
+type status struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+
+	Image      string  `json:"image"`
+	ImageError string  `json:"image_error,omitempty"` // Why the image could not be loaded.
+	Index      int     `json:"index"`                 // Counted from 1.
+	Count      int     `json:"count"`
+	Width      int     `json:"width"`
+	Height     int     `json:"height"`
+	Zoom       float64 `json:"zoom"`
+	Page       int     `json:"page,omitempty"` // Counted from 1, for multi-page images.
+	Pages      int     `json:"pages,omitempty"`
+	Marked     bool    `json:"marked"`
+	Marks      int     `json:"marks"` // Number of marked images.
+}
+
+// remoteReq is a command read from the socket, the status is sent on reply
+// once it has run. A nil cmd only asks for the status.
+type remoteReq struct {
+	cmd   cmd
+	reply chan status
+}
+
+// sock is the socket listened on, if any.
+var sock net.Listener
+
+// socketPath returns the default path of the socket.
+func socketPath() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "vimg.sock")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("vimg-%d.sock", os.Getuid()))
+}
+
+// listenRemote listens on the socket at path, and sends the commands read
+// from it on reqs.
+func listenRemote(path string, reqs chan<- remoteReq) error {
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		// A socket left behind by an instance that did not exit cleanly
+		// can be replaced, one still answering can't.
+		fi, serr := os.Lstat(path)
+		if serr != nil || fi.Mode()&os.ModeSocket == 0 {
+			return err
+		}
+		if conn, derr := net.Dial("unix", path); derr == nil {
+			conn.Close()
+			return fmt.Errorf("%s is used by another instance, not listening", path)
+		}
+		os.Remove(path)
+		if l, err = net.Listen("unix", path); err != nil {
+			return err
+		}
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return err
+	}
+	sock = l
+	lg("Listening on %s", path)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				// Closed by stopRemote.
+				return
+			}
+			go serveRemote(conn, reqs)
+		}
+	}()
+	return nil
+}
+
+// stopRemote closes the socket, which removes it.
+func stopRemote() {
+	if sock != nil {
+		sock.Close()
+	}
+}
+
+// serveRemote runs the commands read from conn until it is closed.
+func serveRemote(conn net.Conn, reqs chan<- remoteReq) {
+	defer conn.Close()
+	enc := json.NewEncoder(conn)
+	sc := bufio.NewScanner(conn)
+	for sc.Scan() {
+		// Commands that can't be run still get the status.
+		cmd, err := remoteCmd(sc.Text())
+		reply := make(chan status, 1)
+		reqs <- remoteReq{cmd, reply}
+		st := <-reply
+		if st.OK = err == nil; err != nil {
+			st.Error = err.Error()
+		}
+		if err := enc.Encode(st); err != nil {
+			lg("Remote: %s", err)
+			return
+		}
+	}
+}
+
+// remoteCmd parses a line read from the socket. Canvas.exec only logs the
+// errors it finds, so what can be checked beforehand is checked here.
+func remoteCmd(line string) (cmd, error) {
+	if strings.TrimSpace(line) == "" {
+		return nil, nil
+	}
+	c, err := parseCmd(line)
+	if err != nil {
+		return nil, err
+	}
+	if len(c) == 1 && c[0] == "status" {
+		return nil, nil
+	}
+	for _, c := range c.split() {
+		n, ok := commands[c[0]]
+		switch {
+		case c[0] == "!":
+		case !ok:
+			return nil, fmt.Errorf("unrecognized command: %s", c[0])
+		case c[0] == "prompt":
+			// The window would not send the keys typed to the prompt.
+			return nil, fmt.Errorf("%s can't be run remotely", c[0])
+		case len(c)-1 < n:
+			return nil, fmt.Errorf("missing arguments: %s", strings.Join(c, " "))
+		}
+	}
+	return c, nil
+}
+
+// status returns the status of the viewer.
+func (c *Canvas) status() status {
+	st := status{
+		Image:  c.i.name,
+		Index:  c.current + 1,
+		Count:  len(c.imgs),
+		Zoom:   c.zoom,
+		Marked: c.i.marked,
+		Marks:  c.marks(),
+	}
+	if v := c.i.vimage; v != nil {
+		b := v.Bounds()
+		st.Width, st.Height = b.Dx(), b.Dy()
+		if v.err != nil {
+			st.ImageError = v.err.Error()
+		}
+		if v.pages > 1 {
+			st.Page, st.Pages = c.i.page+1, v.pages
+		}
+	}
+	return st
+}
+
+// remoteClient sends args, joined by spaces, as a command to the instance
+// listening on the socket at path and prints the reply. Without args, every
+// line read from the standard input is sent instead.
+func remoteClient(path string, args []string) error {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var lines *bufio.Scanner
+	if len(args) > 0 {
+		lines = bufio.NewScanner(strings.NewReader(strings.Join(args, " ")))
+	} else {
+		lines = bufio.NewScanner(os.Stdin)
+	}
+	replies := bufio.NewReader(conn)
+	failed := false
+	for lines.Scan() {
+		if _, err := fmt.Fprintln(conn, lines.Text()); err != nil {
+			return err
+		}
+		reply, err := replies.ReadBytes('\n')
+		if err == io.EOF && len(reply) == 0 {
+			// The viewer quit.
+			return nil
+		} else if err != nil {
+			return err
+		}
+		os.Stdout.Write(reply)
+
+		var st status
+		if err := json.Unmarshal(reply, &st); err != nil {
+			return err
+		}
+		if !st.OK {
+			errLg.Printf("%s: %s", lines.Text(), st.Error)
+			failed = true
+		}
+	}
+	if err := lines.Err(); err != nil {
+		return err
+	}
+	if failed {
+		return fmt.Errorf("some commands failed")
+	}
+	return nil
+}
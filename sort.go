@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+	"unicode"
+)
+
+// sortOrders lists the orders accepted by sortImages, for the help of the
+// sort flag.
+const sortOrders = "'none' (order found), 'name', 'natural' (numbers by value), " +
+	"'mtime', 'size', 'exif' (date taken) or 'shuffle'"
+
+// sortKey returns the function computing the key images are sorted by in
+// order, and the function comparing two keys. Shuffling has no keys.
+func sortKey(order string) (key func(im *Img) interface{}, less func(a, b interface{}) bool, err error) {
+	switch order {
+	case "none":
+		key = func(im *Img) interface{} { return im.seq }
+		less = func(a, b interface{}) bool { return a.(int) < b.(int) }
+	case "name":
+		key = func(im *Img) interface{} { return im.name }
+		less = func(a, b interface{}) bool { return a.(string) < b.(string) }
+	case "natural":
+		key = func(im *Img) interface{} { return im.name }
+		less = func(a, b interface{}) bool { return naturalLess(a.(string), b.(string)) }
+	case "mtime":
+		key = func(im *Img) interface{} { return modTime(im.src) }
+		less = func(a, b interface{}) bool { return a.(time.Time).Before(b.(time.Time)) }
+	case "size":
+		key = func(im *Img) interface{} {
+			if fi, err := im.src.stat(); err == nil {
+				return fi.Size()
+			}
+			return int64(0)
+		}
+		less = func(a, b interface{}) bool { return a.(int64) < b.(int64) }
+	case "exif":
+		key = func(im *Img) interface{} { return takenTime(im.src) }
+		less = func(a, b interface{}) bool { return a.(time.Time).Before(b.(time.Time)) }
+	case "shuffle":
+	default:
+		err = fmt.Errorf("unknown sort order '%s', want %s", order, sortOrders)
+	}
+	return
+}
+
+// sortImages sorts imgs in place. The sort is stable, so images that compare
+// equal keep the order they were found in. Keys can be expensive (a stat or
+// reading the file header), they are only computed for the images that have
+// none in keys yet, and kept there. keys may be nil.
+func sortImages(imgs []*Img, order string, reverse bool, keys map[*Img]interface{}) error {
+	key, less, err := sortKey(order)
+	if err != nil {
+		return err
+	}
+	if order == "shuffle" {
+		rand.Seed(time.Now().UnixNano())
+		for i := len(imgs) - 1; i > 0; i-- {
+			j := rand.Intn(i + 1)
+			imgs[i], imgs[j] = imgs[j], imgs[i]
+		}
+		return nil
+	}
+
+	if keys == nil {
+		keys = make(map[*Img]interface{}, len(imgs))
+	}
+	for _, im := range imgs {
+		if _, ok := keys[im]; !ok {
+			keys[im] = key(im)
+		}
+	}
+	sort.SliceStable(imgs, func(i, j int) bool {
+		if reverse {
+			return less(keys[imgs[j]], keys[imgs[i]])
+		}
+		return less(keys[imgs[i]], keys[imgs[j]])
+	})
+	return nil
+}
+
+// sort re-sorts the image list, keeping the current image selected. The
+// arguments are an order and optionally "reverse", or just "reverse" to
+// reverse the current order.
+func (c *Canvas) sort(args []string) {
+	var err error
+	switch {
+	case args[0] == "reverse":
+		for i, j := 0, len(c.imgs)-1; i < j; i, j = i+1, j-1 {
+			c.imgs[i], c.imgs[j] = c.imgs[j], c.imgs[i]
+		}
+		c.reverse = !c.reverse
+	case len(args) > 1 && args[1] != "reverse":
+		err = fmt.Errorf("unexpected argument '%s'", args[1])
+	default:
+		// Files may have changed since the keys were computed.
+		keys := map[*Img]interface{}{}
+		if err = sortImages(c.imgs, args[0], len(args) > 1, keys); err == nil {
+			c.order, c.reverse, c.keys = args[0], len(args) > 1, keys
+		}
+	}
+	if err != nil {
+		errLg.Printf("Could not sort: %s", err)
+		return
+	}
+	c.reselect()
+}
+
+// insert adds ims to the image list at their place in the current sort order.
+func (c *Canvas) insert(ims ...*Img) {
+	for _, im := range ims {
+		c.place(im)
+	}
+	c.reselect()
+}
+
+// place adds im to the image list after the images that sort before it or
+// compare equal, as if it was found last. The list is sorted by the keys in
+// c.keys, only the keys of the images compared with are computed.
+func (c *Canvas) place(im *Img) {
+	if c.order == "shuffle" {
+		c.imgs = append(c.imgs, im)
+		i := rand.Intn(len(c.imgs))
+		c.imgs[i], c.imgs[len(c.imgs)-1] = im, c.imgs[i]
+		return
+	}
+
+	key, less, _ := sortKey(c.order)
+	cached := func(im *Img) interface{} {
+		k, ok := c.keys[im]
+		if !ok {
+			k = key(im)
+			c.keys[im] = k
+		}
+		return k
+	}
+	k := cached(im)
+	i := sort.Search(len(c.imgs), func(i int) bool {
+		if c.reverse {
+			return less(cached(c.imgs[i]), k)
+		}
+		return less(k, cached(c.imgs[i]))
+	})
+	c.imgs = append(c.imgs, nil)
+	copy(c.imgs[i+1:], c.imgs[i:])
+	c.imgs[i] = im
+}
+
+// reselect finds the current image after the image list was reordered.
+func (c *Canvas) reselect() {
+	for i, im := range c.imgs {
+		if im == c.i {
+			c.current = i
+		}
+	}
+	preload(c.imgs, c.current)
+}
+
+// naturalLess compares strings treating runs of digits as numbers, so that
+// "img2" sorts before "img10". Letters are compared ignoring case first.
+func naturalLess(a, b string) bool {
+	ra, rb := []rune(a), []rune(b)
+	i, j := 0, 0
+	zeros := 0 // Difference of leading zeros in the first numbers that had any.
+	for i < len(ra) && j < len(rb) {
+		if unicode.IsDigit(ra[i]) && unicode.IsDigit(rb[j]) {
+			// Compare the numbers without leading zeros: first by number of
+			// digits, then digit by digit.
+			si, sj := i, j
+			for si < len(ra) && ra[si] == '0' {
+				si++
+			}
+			for sj < len(rb) && rb[sj] == '0' {
+				sj++
+			}
+			ei, ej := si, sj
+			for ei < len(ra) && unicode.IsDigit(ra[ei]) {
+				ei++
+			}
+			for ej < len(rb) && unicode.IsDigit(rb[ej]) {
+				ej++
+			}
+			if ei-si != ej-sj {
+				return ei-si < ej-sj
+			}
+			if na, nb := string(ra[si:ei]), string(rb[sj:ej]); na != nb {
+				return na < nb
+			}
+			if zeros == 0 {
+				zeros = (si - i) - (sj - j)
+			}
+			i, j = ei, ej
+			continue
+		}
+
+		ca, cb := unicode.ToLower(ra[i]), unicode.ToLower(rb[j])
+		if ca != cb {
+			return ca < cb
+		}
+		i++
+		j++
+	}
+	if len(ra)-i != len(rb)-j {
+		return len(ra)-i < len(rb)-j
+	}
+	// Same value, fewer leading zeros first.
+	if zeros != 0 {
+		return zeros < 0
+	}
+	return a < b
+}
+
+func modTime(src source) time.Time {
+	if fi, err := src.stat(); err == nil {
+		return fi.ModTime()
+	}
+	return time.Time{}
+}
+
+// takenTime returns the Exif date of the picture in src, or its modification
+// time if it has none.
+func takenTime(src source) time.Time {
+	f, err := src.open()
+	if err != nil {
+		return time.Time{}
+	}
+	defer f.Close()
+
+	if t, ok := readExif(f).dateTime(); ok {
+		return t
+	}
+	return modTime(src)
+}
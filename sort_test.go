@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestNaturalLess(t *testing.T) {
+	for _, tt := range []struct {
+		a, b string
+		want bool
+	}{
+		{"img2", "img10", true},
+		{"img10", "img2", false},
+		{"img2.png", "img2.png", false},
+		{"x9y", "x10a", true},
+		{"a2b3", "a2b10", true},
+		{"a10b1", "a2b10", false},
+		// Numbers longer than any integer type.
+		{"p99999999999999999999", "p100000000000000000000", true},
+		// Same value, fewer leading zeros first.
+		{"img1", "img01", true},
+		{"img01", "img1", false},
+		{"img001", "img2", true},
+		{"img010", "img9", false},
+		{"a01b2", "a1b02", false},
+		{"a1b02", "a01b2", true},
+		// Digits against text.
+		{"1a", "a1", true},
+		{"a1", "ab", true},
+		{"a", "a1", true},
+		{"a1", "a", false},
+		{"img", "img0", true},
+		// Letters ignoring case first.
+		{"apple", "Banana", true},
+		{"Banana", "apple", false},
+		{"IMG1", "img1", true},
+		{"img1", "IMG1", false},
+		{"img2.jpg", "IMG10.jpg", true},
+		{"é2", "é10", true},
+	} {
+		if got := naturalLess(tt.a, tt.b); got != tt.want {
+			t.Errorf("naturalLess(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+// testInfo is the os.FileInfo of a memSource.
+type testInfo struct {
+	size  int64
+	mtime time.Time
+}
+
+func (fi testInfo) Name() string       { return "" }
+func (fi testInfo) Size() int64        { return fi.size }
+func (fi testInfo) Mode() os.FileMode  { return 0644 }
+func (fi testInfo) ModTime() time.Time { return fi.mtime }
+func (fi testInfo) IsDir() bool        { return false }
+func (fi testInfo) Sys() interface{}   { return nil }
+
+func TestSortImages(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2020, 1, d, 0, 0, 0, 0, time.UTC) }
+	// Found in this order, with sizes and modification times made up.
+	var imgs []*Img
+	for _, im := range []struct {
+		name  string
+		size  int64
+		mtime time.Time
+		taken string // Exif date, if any.
+	}{
+		{"b10.jpg", 300, day(3), "2019:05:01 12:00:00"},
+		{"B2.jpg", 100, day(1), ""},
+		{"a.jpg", 200, day(2), "2019:01:01 12:00:00"},
+		{"b1.jpg", 100, day(5), ""},
+	} {
+		var data []byte
+		if im.taken != "" {
+			data = exifJPEG(binary.BigEndian, exifTags{original: im.taken})
+		}
+		src := &memSource{data: data, info: testInfo{im.size, im.mtime}}
+		imgs = append(imgs, newSourceImg(im.name, src))
+	}
+
+	for _, tt := range []struct {
+		order   string
+		reverse bool
+		want    string
+	}{
+		{"none", false, "[b10.jpg B2.jpg a.jpg b1.jpg]"},
+		{"none", true, "[b1.jpg a.jpg B2.jpg b10.jpg]"},
+		{"name", false, "[B2.jpg a.jpg b1.jpg b10.jpg]"},
+		{"natural", false, "[a.jpg b1.jpg B2.jpg b10.jpg]"},
+		{"natural", true, "[b10.jpg B2.jpg b1.jpg a.jpg]"},
+		{"mtime", false, "[B2.jpg a.jpg b10.jpg b1.jpg]"},
+		// Same size, the order found is kept.
+		{"size", false, "[B2.jpg b1.jpg a.jpg b10.jpg]"},
+		{"size", true, "[b10.jpg a.jpg B2.jpg b1.jpg]"},
+		// Without an Exif date, the modification time counts.
+		{"exif", false, "[a.jpg b10.jpg B2.jpg b1.jpg]"},
+	} {
+		// Always from the order found.
+		sortImages(imgs, "none", false, nil)
+		if err := sortImages(imgs, tt.order, tt.reverse, nil); err != nil {
+			t.Errorf("%s: %s", tt.order, err)
+			continue
+		}
+		var names []string
+		for _, im := range imgs {
+			names = append(names, im.name)
+		}
+		if got := fmt.Sprint(names); got != tt.want {
+			t.Errorf("sorting by %s (reverse %v): got %s, want %s", tt.order, tt.reverse, got, tt.want)
+		}
+	}
+
+	if err := sortImages(imgs, "color", false, nil); err == nil {
+		t.Errorf("sorting by an unknown order did not fail")
+	}
+}
+
+// statCounter is a source that counts how many times it is asked for its
+// size.
+type statCounter struct {
+	*memSource
+	stats *int
+}
+
+func (s statCounter) stat() (os.FileInfo, error) {
+	*s.stats++
+	return s.memSource.stat()
+}
+
+func TestPlace(t *testing.T) {
+	for _, reverse := range []bool{false, true} {
+		stats := 0
+		c := &Canvas{order: "size", reverse: reverse, keys: map[*Img]interface{}{}}
+		// Sizes in an order that lands them everywhere, with duplicates.
+		var sizes []int64
+		for i := 0; i < 1000; i++ {
+			sizes = append(sizes, int64(i*7919%500))
+		}
+		for i, size := range sizes {
+			src := statCounter{&memSource{info: testInfo{size: size}}, &stats}
+			c.place(newSourceImg(fmt.Sprint(i), src))
+		}
+
+		// Every key is computed once.
+		if stats != len(sizes) {
+			t.Errorf("reverse %v: the size of %d images was read %d times", reverse, len(sizes), stats)
+		}
+
+		// The same as sorting them all at once.
+		want := append([]*Img(nil), c.imgs...)
+		sortImages(want, "none", false, nil)
+		sortImages(want, "size", reverse, nil)
+		for i := range want {
+			if c.imgs[i] != want[i] {
+				t.Errorf("reverse %v: image %d is %s, want %s", reverse, i, c.imgs[i].name, want[i].name)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// Images usually come from files, but not always: they can be piped on stdin
+// or be members of an archive. Each Img reads its data from a source, which
+// can be opened again every time the image is loaded.
+
+// source is where the data of an image comes from.
+type source interface {
+	// open returns the data of the image, to be closed once read.
+	open() (imageData, error)
+	// stat returns the size and modification time of the data.
+	stat() (os.FileInfo, error)
+	// file returns the name of the file holding only this image, or "" if
+	// there is none (the image can't be written to, or handed to external
+	// commands).
+	file() string
+}
+
+// imageData is the data of an image, decoders need to read it more than once.
+type imageData interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+	io.Closer
+}
+
+var errNoFile = errors.New("not a file")
+
+// fileSource is an image file.
+type fileSource string
+
+func (f fileSource) open() (imageData, error)   { return os.Open(string(f)) }
+func (f fileSource) stat() (os.FileInfo, error) { return os.Stat(string(f)) }
+func (f fileSource) file() string               { return string(f) }
+
+// memSource is an image held in memory.
+type memSource struct {
+	data []byte
+	info os.FileInfo // Nil if unknown.
+}
+
+// memData is the data of a memSource, it needs no closing.
+type memData struct {
+	*bytes.Reader
+}
+
+func (memData) Close() error { return nil }
+
+func (m *memSource) open() (imageData, error) {
+	return memData{bytes.NewReader(m.data)}, nil
+}
+
+func (m *memSource) stat() (os.FileInfo, error) {
+	if m.info == nil {
+		return nil, errNoFile
+	}
+	return m.info, nil
+}
+
+func (m *memSource) file() string { return "" }
+
+// stdinName is the name of the image read from stdin when "-" is given as an
+// argument.
+const stdinName = "stdin"
+
+// readStdin reads the image piped on stdin.
+func readStdin() (*memSource, error) {
+	data, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return nil, err
+	}
+	return &memSource{data: data}, nil
+}
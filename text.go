@@ -0,0 +1,82 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"unicode/utf8"
+
+	"github.com/BurntSushi/xgbutil/xgraphics"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// Text drawn on top of the image (the command line, messages...) uses a fixed
+// size bitmap font, so vimg does not depend on any font being installed.
+var (
+	textFace = basicfont.Face7x13
+	textFg   = color.RGBA{0xff, 0xff, 0xff, 0xff}
+	textBg   = color.RGBA{0x00, 0x00, 0x00, 0xff}
+)
+
+const textPad = 2 // Margin (in pixels) around text.
+
+// textSize returns the size of the box needed to draw lines.
+func textSize(lines []string) image.Point {
+	w := 0
+	for _, l := range lines {
+		w = max(w, utf8.RuneCountInString(l))
+	}
+	return image.Pt(w*textFace.Advance+2*textPad, len(lines)*textFace.Height+2*textPad)
+}
+
+// textFit returns the last characters of s that fit in width pixels.
+func textFit(s string, width int) string {
+	n := (width - 2*textPad) / textFace.Advance
+	if r := []rune(s); len(r) > n {
+		return string(r[len(r)-max(n, 0):])
+	}
+	return s
+}
+
+// textImage draws lines into a new image of the given size (or just big enough
+// for the text if size is zero), over a solid background.
+func textImage(lines []string, size image.Point) *xgraphics.Image {
+	return xgraphics.NewConvert(window.X, textRGBA(lines, size))
+}
+
+// textRGBA is textImage for images that are not drawn to X right away.
+func textRGBA(lines []string, size image.Point) *image.RGBA {
+	if size == (image.Point{}) {
+		size = textSize(lines)
+	}
+	img := image.NewRGBA(image.Rectangle{Max: size})
+	draw.Draw(img, img.Bounds(), image.NewUniform(textBg), image.ZP, draw.Src)
+	drawText(img, lines)
+	return img
+}
+
+// drawText draws lines over whatever is already in dst.
+func drawText(dst draw.Image, lines []string) {
+	min := dst.Bounds().Min
+	d := font.Drawer{Dst: dst, Src: image.NewUniform(textFg), Face: textFace}
+	for i, l := range lines {
+		d.Dot = fixed.P(min.X+textPad, min.Y+textPad+i*textFace.Height+textFace.Ascent)
+		d.DrawString(l)
+	}
+}
+
+// overlay paints ximg with its top-left corner at pt of the window, on top of
+// the current image. The pixmap of ximg is freed afterwards, it is only meant
+// to be used once.
+func (c *Canvas) overlay(ximg *xgraphics.Image, pt image.Point) {
+	if err := ximg.CreatePixmap(); err != nil {
+		errLg.Print(err)
+		return
+	}
+	ximg.XDraw()
+	ximg.XExpPaint(window.Id, pt.X, pt.Y)
+	ximg.Destroy()
+	c.overlays = append(c.overlays, ximg.Bounds().Add(pt))
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/binary"
+	"image"
+	"io"
+
+	"golang.org/x/image/tiff"
+)
+
+// golang.org/x/image/tiff only decodes the first page of a TIFF file. The
+// other pages are decoded by handing it a view of the file whose header
+// points to the image file directory of the page wanted instead.
+
+// maxTIFFPages bounds the number of pages looked for in a (possibly corrupt)
+// file.
+const maxTIFFPages = 1 << 12
+
+// tiffPages returns the byte order and the offsets of the image file
+// directories of a TIFF file, one per page. It returns no offsets if r is not
+// a TIFF file.
+func tiffPages(r io.ReaderAt) (order binary.ByteOrder, ifds []uint32) {
+	var buf [8]byte
+	if _, err := r.ReadAt(buf[:], 0); err != nil {
+		return nil, nil
+	}
+	switch string(buf[:4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	default:
+		return nil, nil
+	}
+
+	seen := map[uint32]bool{}
+	for off := order.Uint32(buf[4:]); off != 0 && !seen[off]; {
+		if len(ifds) == maxTIFFPages {
+			break
+		}
+		if _, err := r.ReadAt(buf[:2], int64(off)); err != nil {
+			break
+		}
+		ifds = append(ifds, off)
+		seen[off] = true
+
+		// The entries (12 bytes each) are followed by the offset of the
+		// next directory.
+		n := int64(order.Uint16(buf[:2]))
+		if _, err := r.ReadAt(buf[:4], int64(off)+2+12*n); err != nil {
+			break
+		}
+		off = order.Uint32(buf[:4])
+	}
+	return order, ifds
+}
+
+// tiffPage is a TIFF file whose header points to the directory at ifd.
+type tiffPage struct {
+	io.ReaderAt
+	ifd [4]byte
+	off int64
+}
+
+func newTIFFPage(r io.ReaderAt, order binary.ByteOrder, ifd uint32) *tiffPage {
+	p := &tiffPage{ReaderAt: r}
+	order.PutUint32(p.ifd[:], ifd)
+	return p
+}
+
+func (p *tiffPage) ReadAt(b []byte, off int64) (int, error) {
+	n, err := p.ReaderAt.ReadAt(b, off)
+	for i := range p.ifd {
+		if j := 4 + int64(i) - off; j >= 0 && j < int64(n) {
+			b[j] = p.ifd[i]
+		}
+	}
+	return n, err
+}
+
+func (p *tiffPage) Read(b []byte) (int, error) {
+	n, err := p.ReadAt(b, p.off)
+	p.off += int64(n)
+	return n, err
+}
+
+// decodeTIFFPage decodes page (counted from 0) of a multi-page TIFF file.
+func decodeTIFFPage(r io.ReaderAt, order binary.ByteOrder, ifds []uint32, page int) (image.Image, error) {
+	return tiff.Decode(newTIFFPage(r, order, ifds[page]))
+}
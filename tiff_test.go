@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"testing"
+)
+
+// multiPageTIFF returns an uncompressed TIFF file with a page for every
+// image.
+func multiPageTIFF(order binary.ByteOrder, pages ...*image.Gray) []byte {
+	var buf bytes.Buffer
+	if order == binary.LittleEndian {
+		buf.WriteString("II*\x00")
+	} else {
+		buf.WriteString("MM\x00*")
+	}
+	// Patched with the offset of the first directory.
+	binary.Write(&buf, order, uint32(0))
+	next := 4
+
+	for _, p := range pages {
+		b := p.Bounds()
+		strip := buf.Len()
+		buf.Write(p.Pix)
+		if buf.Len()%2 == 1 {
+			buf.WriteByte(0)
+		}
+
+		order.PutUint32(buf.Bytes()[next:], uint32(buf.Len()))
+		entries := [][3]uint32{ // Tag, type (3 is SHORT, 4 is LONG) and value.
+			{256, 4, uint32(b.Dx())},     // ImageWidth
+			{257, 4, uint32(b.Dy())},     // ImageLength
+			{258, 3, 8},                  // BitsPerSample
+			{259, 3, 1},                  // Compression: none
+			{262, 3, 1},                  // PhotometricInterpretation: black is zero
+			{273, 4, uint32(strip)},      // StripOffsets
+			{277, 3, 1},                  // SamplesPerPixel
+			{278, 4, uint32(b.Dy())},     // RowsPerStrip
+			{279, 4, uint32(len(p.Pix))}, // StripByteCounts
+		}
+		binary.Write(&buf, order, uint16(len(entries)))
+		for _, e := range entries {
+			binary.Write(&buf, order, uint16(e[0]))
+			binary.Write(&buf, order, uint16(e[1]))
+			binary.Write(&buf, order, uint32(1))
+			if e[1] == 3 {
+				binary.Write(&buf, order, [2]uint16{uint16(e[2])})
+			} else {
+				binary.Write(&buf, order, e[2])
+			}
+		}
+		next = buf.Len()
+		binary.Write(&buf, order, uint32(0))
+	}
+	return buf.Bytes()
+}
+
+func TestTIFFPages(t *testing.T) {
+	pages := []*image.Gray{
+		gray(3, 2, 1, 2, 3, 4, 5, 6),
+		gray(2, 3, 10, 20, 30, 40, 50, 60),
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		data := multiPageTIFF(order, pages...)
+		r := bytes.NewReader(data)
+
+		gotOrder, ifds := tiffPages(r)
+		if gotOrder != order || len(ifds) != len(pages) {
+			t.Errorf("%s: tiffPages found %d pages in %s, want %d in %s", order, len(ifds), gotOrder, len(pages), order)
+			continue
+		}
+		for i, want := range pages {
+			im, err := decodeTIFFPage(r, order, ifds, i)
+			if err != nil {
+				t.Errorf("%s: page %d: %s", order, i, err)
+				continue
+			}
+			got, ok := im.(*image.Gray)
+			if !ok || !got.Rect.Eq(want.Rect) || !bytes.Equal(got.Pix, want.Pix) {
+				t.Errorf("%s: page %d is %v, want %v", order, i, im, want)
+			}
+		}
+		// The file itself is left as it is.
+		if !bytes.Equal(data, multiPageTIFF(order, pages...)) {
+			t.Errorf("%s: decoding a page changed the file", order)
+		}
+	}
+
+	for _, data := range []string{"", "II*", "GIF89a..", "II*\x00\x00\x00\x00\x00"} {
+		if _, ifds := tiffPages(bytes.NewReader([]byte(data))); len(ifds) != 0 {
+			t.Errorf("%q: tiffPages found %d pages, want none", data, len(ifds))
+		}
+	}
+}
+
+func TestTIFFPageReadAt(t *testing.T) {
+	data := []byte("II*\x00\x08\x00\x00\x00rest")
+	p := newTIFFPage(bytes.NewReader(data), binary.LittleEndian, 0x04030201)
+	for _, tt := range []struct {
+		off  int64
+		n    int
+		want string
+	}{
+		{0, 12, "II*\x00\x01\x02\x03\x04rest"},
+		{5, 2, "\x02\x03"},
+		{6, 4, "\x03\x04re"},
+		{8, 4, "rest"},
+		{2, 3, "*\x00\x01"},
+	} {
+		b := make([]byte, tt.n)
+		if n, err := p.ReadAt(b, tt.off); err != nil || string(b[:n]) != tt.want {
+			t.Errorf("ReadAt(%d, %d) = %q, %v, want %q", tt.n, tt.off, b[:n], err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"image"
+	"sync/atomic"
+
+	"github.com/BurntSushi/xgbutil/xgraphics"
+)
+
+// Converting a whole image to BGRA and drawing it to a pixmap before showing
+// it is what made large images slow to appear. Instead, the decoded image is
+// kept and split into tiles, which are converted when they are first needed
+// (shown, or sampled when zoomed) and drawn to their own pixmap when they are
+// first painted at 1:1. Tiles that have not been used for a while are dropped
+// once an image has too many of them.
+
+const tileSize = 256 // Width and height of tiles, in pixels.
+
+// tiled is a decoded image, converted to BGRA a tile at a time.
+type tiled struct {
+	src   image.Image
+	ts    []transform // Applied to src, in order.
+	size  image.Point // Size of the image once transformed.
+	blend bool        // Blend into the background, src may have alpha.
+	mode  int32       // Background mode the tiles were blended into.
+	bytes int         // Memory used by src.
+
+	tiles     map[image.Point]*tile // Converted tiles, by tile index.
+	clock     int                   // Incremented on every use of a tile.
+	tileBytes int                   // Memory used by tiles.
+}
+
+type tile struct {
+	*xgraphics.Image // Bounds start at (0, 0), like its pixmap.
+	used             int
+}
+
+// maxTileBytes is the memory the tiles of a single image may use before the
+// least recently used ones are dropped.
+func maxTileBytes() int {
+	return flagCacheSize << 20 / 4
+}
+
+// newTiled returns src, to be shown transformed by ts. Nothing is converted
+// yet.
+func newTiled(src image.Image, ts []transform, blend bool) *tiled {
+	t := &tiled{
+		src:   src,
+		ts:    append([]transform(nil), ts...),
+		blend: blend,
+		bytes: imageBytes(src),
+		tiles: map[image.Point]*tile{},
+	}
+	t.resize()
+	return t
+}
+
+func (t *tiled) resize() {
+	b := t.src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	for _, tr := range t.ts {
+		w, h = tr.size(w, h)
+	}
+	t.size = image.Pt(w, h)
+}
+
+// Bounds returns the bounds of the image once transformed, they always start
+// at (0, 0).
+func (t *tiled) Bounds() image.Rectangle {
+	return image.Rectangle{Max: t.size}
+}
+
+// transform adds tr to the transforms applied to the image. The tiles have to
+// be converted again.
+func (t *tiled) transform(tr transform) {
+	t.ts = append(t.ts, tr)
+	t.resize()
+	t.destroy()
+}
+
+// destroy frees all the tiles.
+func (t *tiled) destroy() {
+	for p, tl := range t.tiles {
+		tl.Destroy()
+		delete(t.tiles, p)
+	}
+	t.tileBytes = 0
+}
+
+// srcRect returns the region of src that ends up in r once transformed.
+func (t *tiled) srcRect(r image.Rectangle) image.Rectangle {
+	b := t.src.Bounds()
+	sizes := []image.Point{b.Size()}
+	for _, tr := range t.ts {
+		w, h := tr.size(sizes[len(sizes)-1].X, sizes[len(sizes)-1].Y)
+		sizes = append(sizes, image.Pt(w, h))
+	}
+	for i := len(t.ts) - 1; i >= 0; i-- {
+		r = t.ts[i].inverse().rect(r, sizes[i+1].X, sizes[i+1].Y)
+	}
+	return r.Add(b.Min)
+}
+
+// tile returns the tile at index p, converting it if needed.
+func (t *tiled) tile(p image.Point) *tile {
+	// Tiles blended into another background have to be converted again.
+	if mode := atomic.LoadInt32(&bgMode); t.blend && mode != t.mode {
+		t.destroy()
+		t.mode = mode
+	}
+
+	t.clock++
+	if tl, ok := t.tiles[p]; ok {
+		tl.used = t.clock
+		return tl
+	}
+
+	r := image.Rect(p.X*tileSize, p.Y*tileSize, (p.X+1)*tileSize, (p.Y+1)*tileSize)
+	r = r.Intersect(t.Bounds())
+	sr := t.srcRect(r)
+	var ck *checker
+	if t.blend {
+		ck = newChecker(t.mode)
+	}
+	ximg := xgraphics.New(window.X, image.Rectangle{Max: sr.Size()})
+	convert(ximg, t.src, sr.Min, ck)
+	for _, tr := range t.ts {
+		ximg = transformX(ximg, tr)
+	}
+
+	t.shrink(maxTileBytes() - len(ximg.Pix))
+	tl := &tile{ximg, t.clock}
+	t.tiles[p] = tl
+	t.tileBytes += len(ximg.Pix)
+	return tl
+}
+
+// shrink drops the least recently used tiles until they use at most n bytes.
+func (t *tiled) shrink(n int) {
+	for t.tileBytes > n && len(t.tiles) > 0 {
+		var lru image.Point
+		oldest := t.clock + 1
+		for p, tl := range t.tiles {
+			if tl.used < oldest {
+				lru, oldest = p, tl.used
+			}
+		}
+		t.tileBytes -= len(t.tiles[lru].Pix)
+		t.tiles[lru].Destroy()
+		delete(t.tiles, lru)
+	}
+}
+
+// each calls f with every tile (converting them as needed) that covers a part
+// of r, and that part in image coordinates.
+func (t *tiled) each(r image.Rectangle, f func(tl *tile, part image.Rectangle)) {
+	r = r.Intersect(t.Bounds())
+	if r.Empty() {
+		return
+	}
+	for ty := r.Min.Y / tileSize; ty <= (r.Max.Y-1)/tileSize; ty++ {
+		for tx := r.Min.X / tileSize; tx <= (r.Max.X-1)/tileSize; tx++ {
+			orig := image.Pt(tx*tileSize, ty*tileSize)
+			part := r.Intersect(image.Rectangle{orig, orig.Add(image.Pt(tileSize, tileSize))})
+			f(t.tile(image.Pt(tx, ty)), part)
+		}
+	}
+}
+
+// prefetch converts the tiles covering r and draws them to their pixmaps, so
+// that showing them later is only a matter of painting.
+func (t *tiled) prefetch(r image.Rectangle) {
+	t.each(r, func(tl *tile, part image.Rectangle) {
+		tl.upload()
+	})
+}
+
+// paint paints the region r of the image with its top-left corner at pt of
+// the window.
+func (t *tiled) paint(r image.Rectangle, pt image.Point) {
+	t.each(r, func(tl *tile, part image.Rectangle) {
+		if !tl.upload() {
+			return
+		}
+		orig := image.Pt(part.Min.X/tileSize*tileSize, part.Min.Y/tileSize*tileSize)
+		tl.SubImage(part.Sub(orig)).XExpPaint(window.Id,
+			pt.X+part.Min.X-r.Min.X, pt.Y+part.Min.Y-r.Min.Y)
+	})
+}
+
+// read copies the region r of the image into dst, with its top-left corner at
+// pt.
+func (t *tiled) read(dst *xgraphics.Image, pt image.Point, r image.Rectangle) {
+	t.each(r, func(tl *tile, part image.Rectangle) {
+		orig := image.Pt(part.Min.X/tileSize*tileSize, part.Min.Y/tileSize*tileSize)
+		for y := part.Min.Y; y < part.Max.Y; y++ {
+			i := tl.PixOffset(part.Min.X-orig.X, y-orig.Y)
+			j := dst.PixOffset(pt.X+part.Min.X-r.Min.X, pt.Y+y-r.Min.Y)
+			copy(dst.Pix[j:j+4*part.Dx()], tl.Pix[i:i+4*part.Dx()])
+		}
+	})
+}
+
+// upload draws the tile to its pixmap, the first time it is called. It
+// returns false if the pixmap could not be created.
+func (tl *tile) upload() bool {
+	if tl.Pixmap != 0 {
+		return true
+	}
+	if err := tl.CreatePixmap(); err != nil {
+		errLg.Print(err)
+		return false
+	}
+	tl.XDraw()
+	return true
+}
+
+// imageBytes returns (about) the memory used by the pixels of im.
+func imageBytes(im image.Image) int {
+	switch im := im.(type) {
+	case *image.RGBA:
+		return len(im.Pix)
+	case *image.NRGBA:
+		return len(im.Pix)
+	case *image.RGBA64:
+		return len(im.Pix)
+	case *image.NRGBA64:
+		return len(im.Pix)
+	case *image.Gray:
+		return len(im.Pix)
+	case *image.Gray16:
+		return len(im.Pix)
+	case *image.Paletted:
+		return len(im.Pix)
+	case *image.CMYK:
+		return len(im.Pix)
+	case *image.YCbCr:
+		return len(im.Y) + len(im.Cb) + len(im.Cr)
+	case *image.NYCbCrA:
+		return len(im.Y) + len(im.Cb) + len(im.Cr) + len(im.A)
+	}
+	b := im.Bounds()
+	return b.Dx() * b.Dy() * 4
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/BurntSushi/xgbutil/xgraphics"
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+)
+
+// transform is one of the rotations or flips that can be applied to an image.
+type transform int
+
+const (
+	rotateCW transform = iota
+	rotateCCW
+	flipH
+	flipV
+)
+
+// transforms maps the arguments of the "rotate" and "flip" commands to the
+// corresponding transform.
+var transforms = map[string]transform{
+	"rotate cw":  rotateCW,
+	"rotate ccw": rotateCCW,
+	"flip h":     flipH,
+	"flip v":     flipV,
+}
+
+// size returns the size of an image of size (w, h) once transformed.
+func (t transform) size(w, h int) (int, int) {
+	if t == rotateCW || t == rotateCCW {
+		return h, w
+	}
+	return w, h
+}
+
+// inverse returns the transform that undoes t.
+func (t transform) inverse() transform {
+	switch t {
+	case rotateCW:
+		return rotateCCW
+	case rotateCCW:
+		return rotateCW
+	}
+	return t
+}
+
+// rect returns where the pixels in r of an image of size (w, h) end up once
+// transformed.
+func (t transform) rect(r image.Rectangle, w, h int) image.Rectangle {
+	x0, y0 := t.point(r.Min.X, r.Min.Y, w, h)
+	x1, y1 := t.point(r.Max.X-1, r.Max.Y-1, w, h)
+	return image.Rect(min(x0, x1), min(y0, y1), max(x0, x1)+1, max(y0, y1)+1)
+}
+
+// point returns where the pixel (x, y) of an image of size (w, h) ends up
+// once transformed. Coordinates are relative to the top-left corner.
+func (t transform) point(x, y, w, h int) (int, int) {
+	switch t {
+	case rotateCW:
+		return h - 1 - y, x
+	case rotateCCW:
+		return y, w - 1 - x
+	case flipH:
+		return w - 1 - x, y
+	}
+	return x, h - 1 - y
+}
+
+// transformX returns a transformed copy of src. It works on the Pix slices
+// directly, so it is fast enough to be done on the fly.
+func transformX(src *xgraphics.Image, t transform) *xgraphics.Image {
+	sb := src.Bounds()
+	w, h := sb.Dx(), sb.Dy()
+	dw, dh := t.size(w, h)
+	dst := xgraphics.New(src.X, image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < h; y++ {
+		srow := src.Pix[src.PixOffset(sb.Min.X, sb.Min.Y+y):]
+		for x := 0; x < w; x++ {
+			dx, dy := t.point(x, y, w, h)
+			i := dy*dst.Stride + dx*4
+			copy(dst.Pix[i:i+4], srow[x*4:x*4+4])
+		}
+	}
+	return dst
+}
+
+// transformImage returns a transformed copy of src, keeping the palette of
+// paletted and gray images so they can be encoded back in the same format.
+func transformImage(src image.Image, t transform) draw.Image {
+	sb := src.Bounds()
+	w, h := sb.Dx(), sb.Dy()
+	dw, dh := t.size(w, h)
+	r := image.Rect(0, 0, dw, dh)
+
+	var dst draw.Image
+	switch src := src.(type) {
+	case *image.Paletted:
+		dst = image.NewPaletted(r, src.Palette)
+	case *image.Gray:
+		dst = image.NewGray(r)
+	default:
+		dst = image.NewNRGBA(r)
+	}
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			dx, dy := t.point(x, y, w, h)
+			dst.Set(dx, dy, src.At(sb.Min.X+x, sb.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+// transform applies t to the current image, keeping the same part of it in
+// the center of the window. If flagWriteBack is set, the file is rewritten
+// too.
+func (c *Canvas) transform(t transform) {
+	vimg := c.i.vimage
+	if vimg.err != nil {
+		return
+	}
+
+	size := scaledSize(vimg.Bounds(), c.zoom)
+	cx, cy := window.Geom.Width()/2, window.Geom.Height()/2
+	x, y := t.point(c.origin.X+min(cx, size.X/2), c.origin.Y+min(cy, size.Y/2),
+		size.X, size.Y)
+
+	if a := vimg.anim; a != nil {
+		for _, f := range a.frames {
+			f.transform(t)
+		}
+	} else {
+		vimg.transform(t)
+	}
+	sched.account(c.i)
+
+	c.origin = c.show(image.Pt(x-cx, y-cy))
+
+	if name := c.i.src.file(); flagWriteBack && name == "" {
+		lg("Not writing '%s', it is not a file.", c.i.name)
+	} else if flagWriteBack {
+		if err := writeBack(name, t); err != nil {
+			errLg.Printf("Could not write '%s': %s", c.i.name, err)
+		}
+	}
+}
+
+// transformGIF applies t to every frame of an animation, moving the frames
+// along with their contents.
+func transformGIF(g *gif.GIF, t transform) {
+	w, h := g.Config.Width, g.Config.Height
+	for i, p := range g.Image {
+		q := transformImage(p, t).(*image.Paletted)
+		q.Rect = t.rect(p.Bounds(), w, h)
+		g.Image[i] = q
+	}
+	g.Config.Width, g.Config.Height = t.size(w, h)
+}
+
+// writeJPEG writes the JPEG stream data to w, with the Exif segment of x (if
+// not nil) inserted after its start of image marker.
+func writeJPEG(w io.Writer, data []byte, x *exif) error {
+	if x == nil {
+		_, err := w.Write(data)
+		return err
+	}
+	var app1 [4]byte
+	app1[0], app1[1] = 0xff, 0xe1
+	binary.BigEndian.PutUint16(app1[2:], uint16(len(x.seg)+2))
+	for _, b := range [][]byte{data[:2], app1[:], x.seg, data[2:]} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeBack decodes the file name again, applies t to it and saves it with
+// the encoder of its original format. The new file is written next to the
+// old one and renamed over it, so a failure never leaves a truncated image.
+func writeBack(name string, t transform) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	im, kind, err := image.Decode(file)
+	if err != nil {
+		return err
+	}
+
+	var encode func(f *os.File) error
+	switch kind {
+	case "jpeg":
+		// The image was shown rotated according to its Exif orientation,
+		// which is applied to the pixels too. The Exif data is kept, with
+		// the orientation reset to normal.
+		if _, err := file.Seek(0, 0); err != nil {
+			return err
+		}
+		x := readExif(file)
+		if !flagNoExif {
+			for _, o := range orientations[x.orientation()] {
+				im = transformImage(im, o)
+			}
+			if x != nil {
+				x.setOrientation(1)
+			}
+		}
+		encode = func(f *os.File) error {
+			var buf bytes.Buffer
+			err := jpeg.Encode(&buf, transformImage(im, t), &jpeg.Options{Quality: 95})
+			if err != nil {
+				return err
+			}
+			return writeJPEG(f, buf.Bytes(), x)
+		}
+	case "png":
+		encode = func(f *os.File) error { return png.Encode(f, transformImage(im, t)) }
+	case "gif":
+		// Decode it again, keeping all the frames of animations.
+		if _, err := file.Seek(0, 0); err != nil {
+			return err
+		}
+		g, err := gif.DecodeAll(file)
+		if err != nil {
+			return err
+		}
+		transformGIF(g, t)
+		encode = func(f *os.File) error { return gif.EncodeAll(f, g) }
+	case "bmp":
+		encode = func(f *os.File) error { return bmp.Encode(f, transformImage(im, t)) }
+	case "tiff":
+		// Only the first page was decoded, the others would be lost.
+		if _, ifds := tiffPages(file); len(ifds) > 1 {
+			return fmt.Errorf("can't write multi-page TIFF files")
+		}
+		encode = func(f *os.File) error {
+			return tiff.Encode(f, transformImage(im, t), &tiff.Options{Compression: tiff.Deflate})
+		}
+	default:
+		return fmt.Errorf("no encoder for format '%s'", kind)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(name), ".vimg-")
+	if err != nil {
+		return err
+	}
+	err = encode(tmp)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	// TempFile creates the file readable by its owner only.
+	if err == nil {
+		err = os.Chmod(tmp.Name(), fi.Mode().Perm())
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), name)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	lg("Wrote transformed '%s'.", name)
+	return nil
+}
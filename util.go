@@ -1,10 +1,13 @@
 package main
 
 import (
-	//"io"
+	"fmt"
 	"log"
 	"os"
-	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/xgbutil/xgraphics"
 )
 
 func min(a, b int) int {
@@ -21,6 +24,27 @@ func max(a, b int) int {
 	return b
 }
 
+// rgb is a 0xRRGGBB color that can be set as a flag in "#rrggbb" format.
+type rgb uint32
+
+func (c *rgb) String() string {
+	return fmt.Sprintf("#%06x", uint32(*c))
+}
+
+func (c *rgb) Set(s string) error {
+	v, err := strconv.ParseUint(strings.TrimPrefix(s, "#"), 16, 24)
+	if err != nil {
+		return fmt.Errorf("invalid color '%s', want #rrggbb", s)
+	}
+	*c = rgb(v)
+	return nil
+}
+
+// BGRA returns the color in the format used by xgraphics.
+func (c rgb) BGRA() xgraphics.BGRA {
+	return xgraphics.BGRA{B: uint8(c), G: uint8(c >> 8), R: uint8(c >> 16), A: 0xff}
+}
+
 // Logging
 var errLg = log.New(os.Stderr, "[vimg error] ", log.Lshortfile)
 
@@ -30,23 +54,3 @@ func lg(format string, v ...interface{}) {
 		log.Printf(format, v...)
 	}
 }
-
-//
-
-func runExternal(cmds []string, img string) {
-	for i := range cmds {
-		if cmds[i] == "%" {
-			cmds[i] = img
-		}
-	}
-	errLg.Println(cmds)
-	c := exec.Command(cmds[0], cmds[1:]...)
-	out, _ := c.CombinedOutput()
-	os.Stderr.Write(out)
-	// Run command in background
-	//er, _ := c.StderrPipe()
-	//ou, _ := c.StdoutPipe()
-	//c.Start()
-	//go func() { io.Copy(os.Stdout, ou) }()
-	//go func() { io.Copy(os.Stderr, er) }()
-}
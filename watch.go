@@ -0,0 +1,46 @@
+package main
+
+import (
+	"path/filepath"
+)
+
+// fsEvent is a change to a file in one of the directories being watched.
+type fsEvent struct {
+	name    string
+	removed bool // The file was deleted or moved away, else it was written.
+	scanned bool // The file is in a directory given as (or found from) an argument.
+}
+
+// fsEvent updates the image list after a change on disk: images whose file
+// changed are loaded again, removed files are dropped, and new files in the
+// directories that were scanned are added.
+func (c *Canvas) fsEvent(ev fsEvent) {
+	i := c.find(ev.name)
+	switch {
+	case ev.removed && i >= 0:
+		lg("'%s' was removed.", ev.name)
+		c.delImage(i)
+	case ev.removed:
+	case i >= 0:
+		lg("'%s' changed, reloading it.", ev.name)
+		sched.forget(c.imgs[i])
+		if i == c.current {
+			c.setImage(i)
+		} else {
+			preload(c.imgs, c.current)
+		}
+	case ev.scanned && wanted(ev.name):
+		lg("'%s' is new, adding it.", ev.name)
+		c.insert(newImg(ev.name))
+	}
+}
+
+// find returns the index of the image for the file name, or -1.
+func (c *Canvas) find(name string) int {
+	for i, im := range c.imgs {
+		if f := im.src.file(); f != "" && filepath.Clean(f) == name {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,140 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const watchMask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO |
+	syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_CREATE
+
+// watch uses inotify to watch the directories that were scanned for images,
+// and the directories holding the files given as arguments, and sends the
+// changes it sees on events. With -r, directories created in (or moved to)
+// the scanned directories are scanned and watched too. It never returns
+// unless something goes wrong.
+func watch(files, dirs []string, events chan<- fsEvent) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		errLg.Printf("Could not watch for changes: %s", err)
+		return
+	}
+
+	// The same directory may be added several times (and under different
+	// names), the kernel hands back the same watch descriptor.
+	type watched struct {
+		dir     string
+		scanned bool
+		depth   int // Below the directory given as an argument, if scanned.
+	}
+	wds := map[int32]*watched{}
+	added := map[string]bool{}
+	add := func(dir string, scanned bool, depth int) {
+		if added[dir] {
+			return
+		}
+		added[dir] = true
+		wd, err := syscall.InotifyAddWatch(fd, dir, watchMask)
+		if err != nil {
+			errLg.Printf("Could not watch '%s': %s", dir, err)
+			return
+		}
+		if w, ok := wds[int32(wd)]; ok {
+			w.scanned = w.scanned || scanned
+		} else {
+			wds[int32(wd)] = &watched{dir, scanned, depth}
+		}
+	}
+	for _, d := range dirs {
+		// The subdirectories found are named after the directory given.
+		depth := 0
+		for _, root := range dirs {
+			depth = max(depth, below(root, d))
+		}
+		add(d, true, depth)
+	}
+	for _, f := range files {
+		add(filepath.Dir(f), false, 0)
+	}
+
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := syscall.Read(fd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			errLg.Printf("Stopped watching for changes: %s", err)
+			return
+		}
+
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			off += syscall.SizeofInotifyEvent
+			name := strings.TrimRight(string(buf[off:off+int(ev.Len)]), "\x00")
+			off += int(ev.Len)
+
+			w := wds[ev.Wd]
+			if w != nil && ev.Mask&syscall.IN_IGNORED != 0 {
+				// The directory is gone, it may be created again.
+				delete(wds, ev.Wd)
+				delete(added, w.dir)
+				continue
+			}
+			if w == nil || name == "" {
+				continue
+			}
+			path := filepath.Join(w.dir, name)
+			if ev.Mask&syscall.IN_ISDIR != 0 {
+				depth := w.depth + 1
+				if ev.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) == 0 || !w.scanned ||
+					!flagRecursive || (flagDepth > 0 && depth > flagDepth) || excluded(path) {
+					continue
+				}
+				// Files may have been put in it before it was watched,
+				// or it was moved here along with them.
+				fi, err := os.Stat(path)
+				if err != nil {
+					continue
+				}
+				add(path, true, depth)
+				fs, ds := dirImages(path, depth, []os.FileInfo{fi})
+				for _, d := range ds {
+					add(d, true, depth+below(path, d))
+				}
+				for _, f := range fs {
+					events <- fsEvent{name: f, scanned: true}
+				}
+				continue
+			}
+			if ev.Mask&syscall.IN_CREATE != 0 {
+				// Files are added once they are written.
+				continue
+			}
+			events <- fsEvent{
+				name:    path,
+				removed: ev.Mask&(syscall.IN_DELETE|syscall.IN_MOVED_FROM) != 0,
+				scanned: w.scanned,
+			}
+		}
+	}
+}
+
+// below returns how far below the directory root dir is, or -1 if it is not
+// in it.
+func below(root, dir string) int {
+	rel, err := filepath.Rel(root, dir)
+	switch {
+	case err != nil || rel == ".." || strings.HasPrefix(rel, "../"):
+		return -1
+	case rel == ".":
+		return 0
+	}
+	return strings.Count(rel, "/") + 1
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// watch is only implemented with inotify, elsewhere changes are not noticed.
+func watch(files, dirs []string, events chan<- fsEvent) {
+	lg("Watching for changes is not supported on this system.")
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"image"
+	"unicode/utf8"
 
 	"github.com/BurntSushi/xgb/xproto"
 
@@ -31,20 +32,21 @@ func newWindow(X *xgbutil.XUtil) *Window {
 	keybind.Initialize(w.X)
 	mousebind.Initialize(w.X)
 
-	err = w.CreateChecked(w.X.RootWin(), 0, 0, 600, 600, xproto.CwBackPixel, 0xffffff)
+	// Go full screen unless a size was asked for.
+	width, height, full := flagWidth, flagHeight, flagWidth == 0 && flagHeight == 0
+	if width == 0 {
+		width = 600
+	}
+	if height == 0 {
+		height = 600
+	}
+
+	err = w.CreateChecked(w.X.RootWin(), 0, 0, width, height,
+		xproto.CwBackPixel, uint32(windowColor()))
 	if err != nil {
 		errLg.Fatalf("Could not create window: %s", err)
 	}
 
-	// Make the window close gracefully using the WM_DELETE_WINDOW protocol.
-	w.WMGracefulClose(func(w *xwindow.Window) {
-		xevent.Detach(w.X, w.Id)
-		keybind.Detach(w.X, w.Id)
-		mousebind.Detach(w.X, w.Id)
-		w.Destroy()
-		xevent.Quit(w.X)
-	})
-
 	// Set WM_STATE so it is interpreted as top-level and is mapped.
 	err = icccm.WmStateSet(w.X, w.Id, &icccm.WmState{State: icccm.StateNormal})
 	if err != nil {
@@ -57,17 +59,27 @@ func newWindow(X *xgbutil.XUtil) *Window {
 
 	w.Map()
 
-	err = ewmh.WmStateReq(w.X, w.Id, ewmh.StateToggle, "_NET_WM_STATE_FULLSCREEN")
-	if err != nil {
-		lg("Failed to go FullScreen:", err)
+	if full {
+		err = ewmh.WmStateReq(w.X, w.Id, ewmh.StateToggle, "_NET_WM_STATE_FULLSCREEN")
+		if err != nil {
+			lg("Failed to go FullScreen: %s", err)
+		}
 	}
 	return &Window{w}
 }
 
 // paint uses the xgbutil/xgraphics package to copy the area corresponding
-// to ximg in its pixmap to the window. It will also issue a clear request
-// before hand to try and avoid artifacts.
-func (w *Window) paint(ximg *xgraphics.Image) {
+// to ximg in its pixmap to the window. It returns where the top-left corner
+// of ximg ended up.
+func (w *Window) paint(ximg *xgraphics.Image) image.Point {
+	pt := w.margin(ximg.Bounds().Size())
+	ximg.XExpPaint(w.Id, pt.X, pt.Y)
+	return pt
+}
+
+// margin returns where the top-left corner of an image of the given size is
+// painted, so that it is centered when it is smaller than the window.
+func (w *Window) margin(size image.Point) image.Point {
 
 	// If the image is bigger than the canvas, this is always (0, 0).
 	// If the image is the same size, then it is also (0, 0).
@@ -75,14 +87,19 @@ func (w *Window) paint(ximg *xgraphics.Image) {
 	// x = (canvas_width - image_width) / 2 and
 	// y = (canvas_height - image_height) / 2
 	xmargin, ymargin := 0, 0
-	if ximg.Bounds().Dx() < w.Geom.Width() {
-		xmargin = (w.Geom.Width() - ximg.Bounds().Dx()) / 2
+	if size.X < w.Geom.Width() {
+		xmargin = (w.Geom.Width() - size.X) / 2
 	}
-	if ximg.Bounds().Dy() < w.Geom.Height() {
-		ymargin = (w.Geom.Height() - ximg.Bounds().Dy()) / 2
+	if size.Y < w.Geom.Height() {
+		ymargin = (w.Geom.Height() - size.Y) / 2
 	}
+	return image.Pt(xmargin, ymargin)
+}
 
-	ximg.XExpPaint(w.Id, xmargin, ymargin)
+// clear fills the rectangle r of the window with its background.
+func (w *Window) clear(r image.Rectangle) {
+	xproto.ClearArea(w.X.Conn(), false, w.Id, int16(r.Min.X), int16(r.Min.Y),
+		uint16(r.Dx()), uint16(r.Dy()))
 }
 
 // setName will set the name of the window
@@ -116,6 +133,12 @@ func (w *Window) setupEventHandlers(chans chans) {
 			w.Geom.HeightSet(int(ev.Height))
 		}).Connect(w.X, w.Id)
 
+	// Close the window with the WM_DELETE_WINDOW protocol like the quit
+	// command does, which prints the marked images.
+	w.WMGracefulClose(func(w *xwindow.Window) {
+		chans.ctl <- cmd{"quit"}
+	})
+
 	// Repaint the window on expose events.
 	xevent.ExposeFun(
 		func(X *xgbutil.XUtil, ev xevent.ExposeEvent) {
@@ -134,14 +157,65 @@ func (w *Window) setupEventHandlers(chans chans) {
 		// We do nothing on mouse release
 		func(X *xgbutil.XUtil, rx, ry, ex, ey int) { return })
 
+	// Key presses are matched against the key bindings here rather than with
+	// keybind callbacks, so that they can go to the command line instead
+	// while it is open. typing is only touched by the X event goroutine.
+	var bound []boundKey
 	for _, kb := range keybinds {
-		k := kb // Needed because the callback closure will capture kb
-		err := keybind.KeyPressFun(
-			func(X *xgbutil.XUtil, ev xevent.KeyPressEvent) {
-				chans.ctl <- k.command
-			}).Connect(w.X, w.Id, k.key, false)
-		if err != nil {
+		mods, codes, err := keybind.ParseString(w.X, kb.key)
+		if err != nil && utf8.RuneCountInString(kb.key) != 1 {
 			errLg.Println(err)
+			continue
+		}
+		bound = append(bound, boundKey{kb, mods, codes})
+	}
+
+	typing := false
+	xevent.KeyPressFun(
+		func(X *xgbutil.XUtil, ev xevent.KeyPressEvent) {
+			mods, code := keybind.DeduceKeyInfo(ev.State, ev.Detail)
+			str := keybind.LookupString(X, mods, code)
+			if typing {
+				if mods&xproto.ModMaskControl != 0 {
+					str = "control-" + str
+				}
+				typing = !promptEnd[str]
+				chans.key <- str
+				return
+			}
+			for _, b := range bound {
+				if b.match(mods, code, str) {
+					for _, c := range b.command.split() {
+						typing = typing || c[0] == "prompt"
+					}
+					chans.ctl <- b.command
+				}
+			}
+		}).Connect(w.X, w.Id)
+}
+
+// boundKey is a key binding along with the modifiers and key codes its key
+// sequence corresponds to.
+type boundKey struct {
+	keyb
+	mods  uint16
+	codes []xproto.Keycode
+}
+
+// match reports whether a key press triggers the binding. Single characters
+// that don't name a key symbol (like ':' or '?') are matched against the
+// string the key press produces, whatever modifiers were needed to type it.
+func (b boundKey) match(mods uint16, code xproto.Keycode, str string) bool {
+	if len(b.codes) == 0 {
+		return str == b.key
+	}
+	if mods != b.mods {
+		return false
+	}
+	for _, c := range b.codes {
+		if c == code {
+			return true
 		}
 	}
+	return false
 }
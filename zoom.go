@@ -0,0 +1,89 @@
+package main
+
+import (
+	"image"
+	"math"
+
+	"github.com/BurntSushi/xgbutil/xgraphics"
+)
+
+// Limits for the zoom factor. Past them there is nothing useful to see.
+const (
+	minZoom = 1.0 / 32
+	maxZoom = 32.0
+)
+
+// setZoom changes the zoom factor of the canvas, keeping the point in the
+// center of the window fixed.
+func (c *Canvas) setZoom(z float64) {
+	z = math.Max(minZoom, math.Min(maxZoom, z))
+	cx, cy := window.Geom.Width()/2, window.Geom.Height()/2
+	c.origin.X = int(float64(c.origin.X+cx)*z/c.zoom) - cx
+	c.origin.Y = int(float64(c.origin.Y+cy)*z/c.zoom) - cy
+	c.zoom, c.fit = z, false
+	c.origin = c.show(c.origin)
+}
+
+// scaled scales the region r (in scaled coordinates) of the current image
+// into the view buffer and draws it to its pixmap. The view buffer is only
+// reallocated when the size of the visible region changes.
+func (c *Canvas) scaled(r image.Rectangle) *xgraphics.Image {
+	if c.view == nil || c.view.Bounds().Size() != r.Size() {
+		if c.view != nil {
+			c.view.Destroy()
+		}
+		c.view = xgraphics.New(window.X, image.Rectangle{Max: r.Size()})
+		if err := c.view.CreatePixmap(); err != nil {
+			errLg.Fatal(err)
+		}
+	}
+	scaleInto(c.view, c.i.vimage.tiled, r.Min, c.zoom)
+	c.view.XDraw()
+	return c.view
+}
+
+// fitZoom returns the zoom factor that makes an image with bounds b fit
+// entirely inside the window.
+func fitZoom(b image.Rectangle, win *Window) float64 {
+	return math.Min(float64(win.Geom.Width())/float64(b.Dx()),
+		float64(win.Geom.Height())/float64(b.Dy()))
+}
+
+// scaledSize returns the size of an image with bounds b scaled by z.
+func scaledSize(b image.Rectangle, z float64) image.Point {
+	return image.Pt(max(1, int(float64(b.Dx())*z+0.5)),
+		max(1, int(float64(b.Dy())*z+0.5)))
+}
+
+// scaleInto fills dst with the pixels of src scaled by z (nearest neighbour),
+// where the top-left pixel of dst corresponds to pt in scaled coordinates.
+// Only the pixels of dst are sampled, so the cost is bounded by the size of
+// the viewport and not by the size of the source image. Like convert, it
+// works on the Pix slices directly to keep interfaces out of the loop.
+func scaleInto(dst *xgraphics.Image, src *tiled, pt image.Point, z float64) {
+	db, sb := dst.Bounds(), src.Bounds()
+
+	// Source columns are the same for every row.
+	xs := make([]int, db.Dx())
+	for x := range xs {
+		xs[x] = min(int(float64(pt.X+x)/z), sb.Dx()-1)
+	}
+
+	for y := 0; y < db.Dy(); y++ {
+		sy := min(int(float64(pt.Y+y)/z), sb.Dy()-1)
+		drow := dst.Pix[dst.PixOffset(db.Min.X, db.Min.Y+y):]
+
+		// Only look the tile up when the column moves into the next one.
+		var srow []uint8
+		tx := -1
+		for x, sx := range xs {
+			if sx/tileSize != tx {
+				tx = sx / tileSize
+				tl := src.tile(image.Pt(tx, sy/tileSize))
+				srow = tl.Pix[tl.PixOffset(0, sy%tileSize):]
+			}
+			i := sx % tileSize * 4
+			copy(drow[x*4:x*4+4], srow[i:i+4])
+		}
+	}
+}